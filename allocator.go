@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// Bitrate set aside for every audio track a peer receives, audio is never paused
+	audioBitrateReserve = 64_000
+	// Bitrate assumed for a video source that hasn't been measured yet
+	minVideoBitrate = 150_000
+	// A paused track only resumes once the budget covers it with this much headroom
+	resumeHeadroom = 1.2
+)
+
+// Priority of a video down-track when the budget is short, lower goes first
+const (
+	priorityPinned = iota
+	prioritySpeaker
+	priorityOther
+)
+
+type trackAllocation struct {
+	TrackID       string `json:"trackId"`
+	SourceTrackID string `json:"sourceTrackId"`
+	StreamID      string `json:"streamId"`
+	Priority      int    `json:"priority"`
+	Bitrate       int    `json:"bitrate"`
+	Available     int    `json:"available"`
+	Paused        bool   `json:"paused"`
+}
+
+type bandwidthAllocation struct {
+	TargetBitrate int               `json:"targetBitrate"`
+	AudioBitrate  int               `json:"audioBitrate"`
+	Tracks        []trackAllocation `json:"tracks"`
+}
+
+// allocateBandwidth splits the target bitrate of every peer across its down-tracks,
+// then caps the publishers at what their subscribers can take
+func allocateBandwidth() {
+	listLock.Lock()
+	defer listLock.Unlock()
+
+	now := time.Now()
+	for _, s := range videoSources {
+		s.sampleBitrate(now)
+	}
+
+	available := map[*videoSource]int{}
+	for _, p := range peerConnections {
+		if p.estimator == nil {
+			continue
+		}
+
+		allocation := p.allocate(p.estimator.GetTargetBitrate())
+		for _, t := range allocation.Tracks {
+			if s, ok := videoSources[t.SourceTrackID]; ok {
+				if bitrate, seen := available[s]; !seen || t.Available < bitrate {
+					available[s] = t.Available
+				}
+			}
+		}
+
+		if allocation.decisions() == p.lastAllocation.decisions() {
+			continue
+		}
+		p.lastAllocation = allocation
+		// The websocket is gone during the grace period
+		if p.signalingLost {
+			continue
+		}
+
+		data, err := json.Marshal(allocation)
+		if err != nil {
+			mainLogger.Errorf("Failed to marshal allocation to json: %v", err)
+			continue
+		}
+
+		mainLogger.Infof("Allocation for peer %s: %s", p.id, data)
+
+		if err = p.websocket.WriteJSON(&websocketMessage{
+			Event: "allocation",
+			Data:  string(data),
+		}); err != nil {
+			mainLogger.Errorf("Failed to write JSON: %v", err)
+		}
+	}
+
+	capPublishers(available)
+}
+
+// allocate forwards as many video down-tracks as the target bitrate allows, in priority
+// order: audio first, then pinned and screen-share, then speakers, then everyone else.
+// Must hold listLock.
+func (p *peerConnectionState) allocate(targetBitrate int) *bandwidthAllocation {
+	allocation := &bandwidthAllocation{TargetBitrate: targetBitrate}
+
+	for _, sender := range p.peerConnection.GetSenders() {
+		if sender.Track() != nil && sender.Track().Kind() == webrtc.RTPCodecTypeAudio {
+			allocation.AudioBitrate += audioBitrateReserve
+		}
+	}
+	budget := targetBitrate - allocation.AudioBitrate
+
+	ranking := speakers.ranking()
+	pinned := map[string]bool{}
+	for _, streamID := range p.pinned {
+		pinned[streamID] = true
+	}
+
+	for _, d := range p.downTracks {
+		s := d.currentSource()
+		if s == nil {
+			continue
+		}
+
+		priority := priorityOther
+		switch {
+		case pinned[s.streamID] || s.screenShare.Load():
+			priority = priorityPinned
+		case !ranking[s.streamID].IsZero():
+			priority = prioritySpeaker
+		}
+
+		allocation.Tracks = append(allocation.Tracks, trackAllocation{
+			TrackID:       d.track.ID(),
+			SourceTrackID: s.id,
+			StreamID:      s.streamID,
+			Priority:      priority,
+			Bitrate:       max(s.getBitrate(), minVideoBitrate),
+			Paused:        d.isPaused(),
+		})
+	}
+
+	// Most recent speakers go first within the speaker priority
+	sort.SliceStable(allocation.Tracks, func(i, j int) bool {
+		a, b := allocation.Tracks[i], allocation.Tracks[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		return ranking[a.StreamID].After(ranking[b.StreamID])
+	})
+
+	for i := range allocation.Tracks {
+		t := &allocation.Tracks[i]
+		need := t.Bitrate
+		if t.Paused {
+			need = int(float64(need) * resumeHeadroom)
+		}
+
+		t.Available = max(budget, 0)
+		t.Paused = need > budget
+		if !t.Paused {
+			budget -= t.Bitrate
+		}
+	}
+
+	for _, t := range allocation.Tracks {
+		for _, d := range p.downTracks {
+			if d.track.ID() == t.TrackID {
+				d.setPaused(t.Paused)
+			}
+		}
+	}
+
+	return allocation
+}
+
+// decisions summarizes which tracks are forwarded, bitrates alone changing is not worth an event.
+// Tracks are sorted by ID, so speakers swapping priority doesn't count either.
+func (a *bandwidthAllocation) decisions() string {
+	if a == nil {
+		return ""
+	}
+
+	decisions := make([]string, 0, len(a.Tracks))
+	for _, t := range a.Tracks {
+		decisions = append(decisions, fmt.Sprintf("%s:%s:%v;", t.TrackID, t.SourceTrackID, t.Paused))
+	}
+	sort.Strings(decisions)
+	return strings.Join(decisions, "")
+}
+
+// setScreenShare marks a video track of the publisher behind pc as screen-share
+func setScreenShare(pc *webrtc.PeerConnection, trackID string, screenShare bool) error {
+	listLock.RLock()
+	defer listLock.RUnlock()
+
+	s, ok := videoSources[trackID]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownTrack, trackID)
+	}
+	if s.publisher != pc {
+		return fmt.Errorf("%w: %s", errNotTrackOwner, trackID)
+	}
+	s.screenShare.Store(screenShare)
+	return nil
+}
@@ -0,0 +1,231 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const arrivalLogHeader = "ArrivalUs,Peer,Track,SSRC,SequenceNumber,Timestamp,Marker,PayloadType,PayloadSize,TransportSeq,AbsSendTime,AudioLevel,Voice,OtherExtensions"
+
+// arrivalLogConfig enables the per-packet log of everything publishers send us
+type arrivalLogConfig struct {
+	// Path of the log, rotated to path.1, path.2, ... An empty path disables the log.
+	Path string `json:"path"`
+	// MaxBytes rotates the log once it grows past this size
+	MaxBytes int64 `json:"maxBytes"`
+	// MaxFiles is the number of rotated logs kept next to the current one
+	MaxFiles int `json:"maxFiles"`
+}
+
+func (c *arrivalLogConfig) setDefaults() {
+	if c.MaxBytes == 0 {
+		c.MaxBytes = 100 << 20
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = 5
+	}
+}
+
+// rotatingFile is a line oriented file that is rotated by size, every file starts with header
+type rotatingFile struct {
+	path     string
+	header   string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func newRotatingFile(path, header string, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, header: header, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.Create(f.path)
+	if err != nil {
+		return err
+	}
+	f.file, f.w, f.size = file, bufio.NewWriter(file), 0
+	return f.write(f.header)
+}
+
+func (f *rotatingFile) write(line string) error {
+	n, err := f.w.WriteString(line + "\n")
+	f.size += int64(n)
+	return err
+}
+
+// WriteLine appends a line, rotating first if it would not fit
+func (f *rotatingFile) WriteLine(line string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	if f.size+int64(len(line)+1) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	return f.write(line)
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	for i := f.maxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.maxFiles > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+	return f.open()
+}
+
+// Flush writes buffered lines to disk
+func (f *rotatingFile) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.w.Flush()
+}
+
+// Close flushes and closes the file
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.w.Flush()
+	if cErr := f.file.Close(); err == nil {
+		err = cErr
+	}
+	f.file = nil
+	return err
+}
+
+// arrivalLog is the per-packet log of inbound RTP, shared by all publisher tracks
+type arrivalLog struct {
+	file *rotatingFile
+}
+
+func newArrivalLog(cfg arrivalLogConfig) (*arrivalLog, error) {
+	file, err := newRotatingFile(cfg.Path, arrivalLogHeader, cfg.MaxBytes, cfg.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lines are buffered, get them to disk regularly so a crash loses at most a second
+	go func() {
+		for range time.NewTicker(time.Second).C {
+			if err := file.Flush(); err != nil {
+				mainLogger.Errorf("Failed to flush arrival log: %v", err)
+			}
+		}
+	}()
+	return &arrivalLog{file: file}, nil
+}
+
+// trackArrivals logs the packets of one inbound track
+type trackArrivals struct {
+	log   *arrivalLog
+	peer  string
+	track string
+
+	transportCCID uint8
+	absSendTimeID uint8
+	audioLevelID  uint8
+}
+
+// track returns the logger of a publisher track, nil when logging is off
+func (l *arrivalLog) track(peer string, t *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) *trackArrivals {
+	if l == nil {
+		return nil
+	}
+
+	a := &trackArrivals{log: l, peer: peer, track: t.ID()}
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		switch ext.URI {
+		case sdp.TransportCCURI:
+			a.transportCCID = uint8(ext.ID)
+		case sdp.ABSSendTimeURI:
+			a.absSendTimeID = uint8(ext.ID)
+		case sdp.AudioLevelURI:
+			a.audioLevelID = uint8(ext.ID)
+		}
+	}
+	return a
+}
+
+// packet logs one packet, the known header extensions are decoded into their own columns
+func (a *trackArrivals) packet(arrival time.Time, pkt *rtp.Packet) {
+	if a == nil {
+		return
+	}
+
+	var transportSeq, absSendTime, audioLevel, voice string
+	other := []string{}
+	for _, id := range pkt.GetExtensionIDs() {
+		payload := pkt.GetExtension(id)
+		switch id {
+		case a.transportCCID:
+			ext := rtp.TransportCCExtension{}
+			if err := ext.Unmarshal(payload); err == nil {
+				transportSeq = strconv.Itoa(int(ext.TransportSequence))
+			}
+		case a.absSendTimeID:
+			ext := rtp.AbsSendTimeExtension{}
+			if err := ext.Unmarshal(payload); err == nil {
+				absSendTime = strconv.FormatUint(ext.Timestamp, 10)
+			}
+		case a.audioLevelID:
+			ext := rtp.AudioLevelExtension{}
+			if err := ext.Unmarshal(payload); err == nil {
+				audioLevel, voice = strconv.Itoa(int(ext.Level)), strconv.FormatBool(ext.Voice)
+			}
+		default:
+			other = append(other, fmt.Sprintf("%d=%s", id, hex.EncodeToString(payload)))
+		}
+	}
+
+	line := fmt.Sprintf("%d,%s,%s,%d,%d,%d,%t,%d,%d,%s,%s,%s,%s,%s",
+		arrival.UnixMicro(), a.peer, a.track, pkt.SSRC, pkt.SequenceNumber, pkt.Timestamp, pkt.Marker, pkt.PayloadType,
+		len(pkt.Payload), transportSeq, absSendTime, audioLevel, voice, strings.Join(other, ";"))
+	if err := a.log.file.WriteLine(line); err != nil {
+		mainLogger.Errorf("Failed to write arrival log: %v", err)
+	}
+}
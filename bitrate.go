@@ -0,0 +1,253 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// bitrateConfig tunes the inbound bitrate trackers
+type bitrateConfig struct {
+	// Window the bitrate is averaged over, in milliseconds
+	Window int `json:"window"`
+	// Resolution is how often the window moves, in milliseconds
+	Resolution int `json:"resolution"`
+	// Alpha weighs the newest bitrate in the EWMA, which is updated every resolution step
+	Alpha float64 `json:"alpha"`
+	// PercentileWindow is how many seconds of bitrates the percentiles are taken over
+	PercentileWindow int `json:"percentileWindow"`
+}
+
+func (c *bitrateConfig) setDefaults() {
+	if c.Window == 0 {
+		c.Window = 1000
+	}
+	if c.Resolution == 0 {
+		c.Resolution = 100
+	}
+	if c.Alpha == 0 {
+		c.Alpha = 0.1
+	}
+	if c.PercentileWindow == 0 {
+		c.PercentileWindow = 10
+	}
+}
+
+func (c *bitrateConfig) validate() error {
+	if c.Resolution <= 0 {
+		return fmt.Errorf("bitrate: resolution %dms must be positive", c.Resolution)
+	}
+	if c.Window < c.Resolution {
+		return fmt.Errorf("bitrate: window %dms is shorter than the resolution of %dms", c.Window, c.Resolution)
+	}
+	if c.Alpha <= 0 || c.Alpha > 1 {
+		return fmt.Errorf("bitrate: alpha %v must be in (0, 1]", c.Alpha)
+	}
+	if c.PercentileWindow*1000 < c.Resolution {
+		return fmt.Errorf("bitrate: percentileWindow %ds is shorter than the resolution of %dms", c.PercentileWindow, c.Resolution)
+	}
+	return nil
+}
+
+// BitrateStats is the state of a BitrateTracker, bitrates in bits per second
+type BitrateStats struct {
+	SSRC    uint32        `json:"ssrc"`
+	RID     string        `json:"rid,omitempty"`
+	Bitrate float64       `json:"bitrate"`
+	EWMA    float64       `json:"ewma"`
+	P50     float64       `json:"p50"`
+	P95     float64       `json:"p95"`
+	Delay   time.Duration `json:"-"`
+	// DelayMs is Delay in milliseconds
+	DelayMs float64 `json:"delay"`
+}
+
+type bitrateBucket struct {
+	bytes      uint64
+	totalDelay time.Duration
+	packets    int
+}
+
+// BitrateTracker helps calculate bitrate for a specific track. Packets are counted in
+// buckets of one resolution step, the bitrate is taken over the buckets of the window.
+type BitrateTracker struct {
+	mu sync.Mutex
+
+	ssrc       uint32
+	rid        string
+	resolution time.Duration
+	alpha      float64
+
+	buckets     []bitrateBucket
+	bucketStart time.Time
+	// bitrate of the window at every step, for the percentiles
+	history []float64
+	maxHist int
+
+	currentBitrate float64
+	ewma           float64
+	currentDelay   time.Duration
+}
+
+// NewBitrateTracker creates a new BitrateTracker
+func NewBitrateTracker(ssrc uint32, rid string, cfg bitrateConfig) *BitrateTracker {
+	cfg.setDefaults()
+	window := max(1, cfg.Window/cfg.Resolution)
+	return &BitrateTracker{
+		ssrc:       ssrc,
+		rid:        rid,
+		resolution: time.Duration(cfg.Resolution) * time.Millisecond,
+		alpha:      cfg.Alpha,
+		buckets:    make([]bitrateBucket, 1, window),
+		maxHist:    max(1, cfg.PercentileWindow*1000/cfg.Resolution),
+	}
+}
+
+// AddPacket adds a new packet and its relative one-way delay to the calculation
+func (bt *BitrateTracker) AddPacket(packetSize int, delay time.Duration) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	bt.advance(time.Now())
+	bucket := &bt.buckets[len(bt.buckets)-1]
+	bucket.bytes += uint64(packetSize)
+	bucket.totalDelay += delay
+	bucket.packets++
+}
+
+// advance closes every bucket that ended before now, idle steps count as empty buckets
+func (bt *BitrateTracker) advance(now time.Time) {
+	if bt.bucketStart.IsZero() {
+		bt.bucketStart = now
+		return
+	}
+
+	for now.Sub(bt.bucketStart) >= bt.resolution {
+		var bytes uint64
+		var totalDelay time.Duration
+		packets := 0
+		for _, b := range bt.buckets {
+			bytes += b.bytes
+			totalDelay += b.totalDelay
+			packets += b.packets
+		}
+
+		bt.currentBitrate = float64(bytes*8) / (time.Duration(len(bt.buckets)) * bt.resolution).Seconds()
+		bt.ewma = bt.alpha*bt.currentBitrate + (1-bt.alpha)*bt.ewma
+		if packets != 0 {
+			bt.currentDelay = totalDelay / time.Duration(packets)
+		}
+		bt.history = append(bt.history, bt.currentBitrate)
+		if len(bt.history) > bt.maxHist {
+			bt.history = bt.history[1:]
+		}
+
+		if len(bt.buckets) == cap(bt.buckets) {
+			copy(bt.buckets, bt.buckets[1:])
+			bt.buckets = bt.buckets[:len(bt.buckets)-1]
+		}
+		bt.buckets = append(bt.buckets, bitrateBucket{})
+		bt.bucketStart = bt.bucketStart.Add(bt.resolution)
+
+		// Don't replay every step of a long pause
+		if now.Sub(bt.bucketStart) > time.Duration(bt.maxHist)*bt.resolution {
+			bt.bucketStart = now
+		}
+	}
+}
+
+// GetBitrate returns the bitrate over the window in bits per second
+func (bt *BitrateTracker) GetBitrate() float64 {
+	return bt.Stats().Bitrate
+}
+
+// GetDelay returns the average relative delay over the window
+func (bt *BitrateTracker) GetDelay() time.Duration {
+	return bt.Stats().Delay
+}
+
+// Stats returns the bitrate, its EWMA and percentiles, and the delay
+func (bt *BitrateTracker) Stats() BitrateStats {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	bt.advance(time.Now())
+	stats := BitrateStats{
+		SSRC:    bt.ssrc,
+		RID:     bt.rid,
+		Bitrate: bt.currentBitrate,
+		EWMA:    bt.ewma,
+		Delay:   bt.currentDelay,
+		DelayMs: float64(bt.currentDelay.Microseconds()) / 1000.0,
+	}
+	if len(bt.history) != 0 {
+		sorted := append([]float64{}, bt.history...)
+		sort.Float64s(sorted)
+		stats.P50 = percentile(sorted, 0.50)
+		stats.P95 = percentile(sorted, 0.95)
+	}
+	return stats
+}
+
+// percentile of sorted values, nearest rank
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	return sorted[max(0, min(len(sorted)-1, rank))]
+}
+
+// bitrateTrackers holds the trackers of a PeerConnection's inbound streams by SSRC
+type bitrateTrackers struct {
+	mu       sync.RWMutex
+	trackers map[uint32]*BitrateTracker
+}
+
+func newBitrateTrackers() *bitrateTrackers {
+	return &bitrateTrackers{trackers: map[uint32]*BitrateTracker{}}
+}
+
+// add creates the tracker of a stream, rid is empty without simulcast
+func (b *bitrateTrackers) add(ssrc uint32, rid string) *BitrateTracker {
+	tracker := NewBitrateTracker(ssrc, rid, config.Bitrate)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trackers[ssrc] = tracker
+	return tracker
+}
+
+func (b *bitrateTrackers) remove(ssrc uint32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.trackers, ssrc)
+}
+
+// get returns the tracker of an SSRC, nil if there is none
+func (b *bitrateTrackers) get(ssrc uint32) *BitrateTracker {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.trackers[ssrc]
+}
+
+// stats returns the stats of every tracker, ordered by SSRC
+func (b *bitrateTrackers) stats() []BitrateStats {
+	b.mu.RLock()
+	trackers := make([]*BitrateTracker, 0, len(b.trackers))
+	for _, tracker := range b.trackers {
+		trackers = append(trackers, tracker)
+	}
+	b.mu.RUnlock()
+
+	stats := make([]BitrateStats, 0, len(trackers))
+	for _, tracker := range trackers {
+		stats = append(stats, tracker.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].SSRC < stats[j].SSRC })
+	return stats
+}
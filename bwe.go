@@ -0,0 +1,278 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
+)
+
+var (
+	errUnknownEstimator = errors.New("unknown bandwidth estimator")
+	errInvalidTrace     = errors.New("invalid bandwidth trace")
+)
+
+// bweConfig selects and parameterizes the bandwidth estimator of every PeerConnection
+type bweConfig struct {
+	// Default is the estimator used when the websocket URL has no ?bwe=
+	Default        string `json:"default"`
+	InitialBitrate int    `json:"initialBitrate"`
+	MinBitrate     int    `json:"minBitrate"`
+	MaxBitrate     int    `json:"maxBitrate"`
+	// FixedBitrate is the target of the fixed estimator
+	FixedBitrate int `json:"fixedBitrate"`
+	// Trace is a CSV of seconds,bitrate the trace estimator plays back
+	Trace string `json:"trace"`
+	// Shadows are estimators that run next to the active one without controlling sending,
+	// used when the websocket URL has no ?shadow=
+	Shadows []string `json:"shadows"`
+	// TWCCTrace records every sent packet and TWCC feedback to twcc-<peer>.trace,
+	// unless the websocket URL has ?twcc-trace=
+	TWCCTrace bool `json:"twccTrace"`
+	// NADA tunes the nada estimator
+	NADA nadaConfig `json:"nada"`
+}
+
+func (c *bweConfig) setDefaults() {
+	if c.Default == "" {
+		c.Default = "gcc"
+	}
+	if c.InitialBitrate == 0 {
+		c.InitialBitrate = 2_000_000
+	}
+	if c.FixedBitrate == 0 {
+		c.FixedBitrate = c.InitialBitrate
+	}
+}
+
+// bandwidthEstimatorFactory creates an estimator that sends through the given pacer
+type bandwidthEstimatorFactory func(cfg bweConfig, pacer gcc.Pacer) (cc.BandwidthEstimator, error)
+
+// bandwidthEstimators are the estimators that can be selected by name
+var bandwidthEstimators = map[string]bandwidthEstimatorFactory{
+	"gcc": func(cfg bweConfig, pacer gcc.Pacer) (cc.BandwidthEstimator, error) {
+		opts := []gcc.Option{
+			gcc.SendSideBWEInitialBitrate(cfg.InitialBitrate),
+			gcc.SendSideBWEPacer(pacer),
+		}
+		if cfg.MinBitrate != 0 {
+			opts = append(opts, gcc.SendSideBWEMinBitrate(cfg.MinBitrate))
+		}
+		if cfg.MaxBitrate != 0 {
+			opts = append(opts, gcc.SendSideBWEMaxBitrate(cfg.MaxBitrate))
+		}
+		return gcc.NewSendSideBWE(opts...)
+	},
+	"fixed": func(cfg bweConfig, pacer gcc.Pacer) (cc.BandwidthEstimator, error) {
+		return newFixedEstimator(cfg.FixedBitrate, pacer), nil
+	},
+	"trace": func(cfg bweConfig, pacer gcc.Pacer) (cc.BandwidthEstimator, error) {
+		return newTraceEstimator(cfg.Trace, pacer)
+	},
+	"nada": func(cfg bweConfig, pacer gcc.Pacer) (cc.BandwidthEstimator, error) {
+		return newNADAEstimator(cfg, pacer), nil
+	},
+}
+
+// newBandwidthEstimator creates the estimator registered as name
+func newBandwidthEstimator(name string, pacer gcc.Pacer) (cc.BandwidthEstimator, error) {
+	factory, ok := bandwidthEstimators[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errUnknownEstimator, name)
+	}
+	return factory(config.BWE, pacer)
+}
+
+// bandwidthEstimatorNames lists the registered estimators
+func bandwidthEstimatorNames() []string {
+	names := make([]string, 0, len(bandwidthEstimators))
+	for name := range bandwidthEstimators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fixedEstimator always targets the same bitrate, for experiments without congestion control
+type fixedEstimator struct {
+	pacer gcc.Pacer
+
+	mu       sync.Mutex
+	bitrate  int
+	onChange func(bitrate int)
+}
+
+func newFixedEstimator(bitrate int, pacer gcc.Pacer) *fixedEstimator {
+	pacer.SetTargetBitrate(bitrate)
+	return &fixedEstimator{pacer: pacer, bitrate: bitrate}
+}
+
+// AddStream sends the stream through the pacer
+func (e *fixedEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	e.pacer.AddStream(info.SSRC, writer)
+	return e.pacer
+}
+
+// WriteRTCP ignores all feedback
+func (e *fixedEstimator) WriteRTCP([]rtcp.Packet, interceptor.Attributes) error {
+	return nil
+}
+
+// GetTargetBitrate returns the current target bitrate in bits per second
+func (e *fixedEstimator) GetTargetBitrate() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.bitrate
+}
+
+// OnTargetBitrateChange sets the callback that is called when the target bitrate changes
+func (e *fixedEstimator) OnTargetBitrateChange(f func(bitrate int)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onChange = f
+}
+
+func (e *fixedEstimator) setTargetBitrate(bitrate int) {
+	e.mu.Lock()
+	changed := bitrate != e.bitrate
+	e.bitrate = bitrate
+	onChange := e.onChange
+	e.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	e.pacer.SetTargetBitrate(bitrate)
+	if onChange != nil {
+		go onChange(bitrate)
+	}
+}
+
+// GetStats returns the target, there is nothing else going on
+func (e *fixedEstimator) GetStats() map[string]interface{} {
+	return map[string]interface{}{
+		"targetBitrate": e.GetTargetBitrate(),
+	}
+}
+
+// Close stops the pacer
+func (e *fixedEstimator) Close() error {
+	return e.pacer.Close()
+}
+
+type traceStep struct {
+	at      time.Duration
+	bitrate int
+}
+
+// traceEstimator plays back a recorded or synthetic target bitrate, starting when the PeerConnection is created
+type traceEstimator struct {
+	*fixedEstimator
+	steps []traceStep
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newTraceEstimator(path string, pacer gcc.Pacer) (*traceEstimator, error) {
+	steps, err := loadTrace(path)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &traceEstimator{
+		fixedEstimator: newFixedEstimator(steps[0].bitrate, pacer),
+		steps:          steps,
+		done:           make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// loadTrace reads lines of seconds,bitrate. Blank lines, # comments and a header are skipped.
+func loadTrace(path string) ([]traceStep, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: the trace estimator needs bwe.trace to be configured", errInvalidTrace)
+	}
+
+	file, err := os.Open(path) //nolint: gosec
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() //nolint: errcheck
+
+	steps := []traceStep{}
+	header := true
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// Only the first line that isn't a comment can be the header
+		first := header
+		header = false
+
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%w: %s:%d: expected seconds,bitrate", errInvalidTrace, path, line)
+		}
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+		if err != nil {
+			if first {
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		bitrate, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		steps = append(steps, traceStep{at: time.Duration(seconds * float64(time.Second)), bitrate: bitrate})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%w: %s is empty", errInvalidTrace, path)
+	}
+
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].at < steps[j].at })
+	return steps, nil
+}
+
+func (e *traceEstimator) run() {
+	start := time.Now()
+	for _, step := range e.steps[1:] {
+		select {
+		case <-e.done:
+			return
+		case <-time.After(time.Until(start.Add(step.at))):
+			e.setTargetBitrate(step.bitrate)
+		}
+	}
+}
+
+// Close stops the playback and the pacer
+func (e *traceEstimator) Close() error {
+	e.once.Do(func() {
+		close(e.done)
+	})
+	return e.fixedEstimator.Close()
+}
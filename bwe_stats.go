@@ -0,0 +1,280 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+// bweSnapshot is the internal state of a connection's estimators at one tick
+type bweSnapshot struct {
+	Peer          string    `json:"peer"`
+	Time          time.Time `json:"time"`
+	Estimator     string    `json:"estimator"`
+	TargetBitrate int       `json:"targetBitrate"`
+	// RTT in milliseconds, from the receiver reports of what we send
+	RTT     float64                           `json:"rtt"`
+	Stats   map[string]interface{}            `json:"stats"`
+	Shadows map[string]map[string]interface{} `json:"shadows,omitempty"`
+}
+
+// bweColumns are the CSV columns of a bweSample before the estimator's own stats and the
+// shadow targets, see statsColumns
+var bweColumns = []string{"timestamp", "experiment", "room", "peer", "estimator", "target_kbps", "rtt_ms"}
+
+// Estimator stats in milliseconds, bitrates are recognized by their name
+var bweStatsMs = map[string]bool{
+	"delayMeasurement": true, "delayEstimate": true, "delayThreshold": true,
+	"queueDelay": true, "baseDelay": true, "signal": true, "rtt": true,
+}
+
+// bweStatColumn names a key of GetStats like the other stats columns, prefixed with the
+// estimator. Bitrates are converted from bps to kbps.
+func bweStatColumn(estimator, key string, value interface{}) (string, interface{}) {
+	unit := ""
+	if base, ok := strings.CutSuffix(key, "Bitrate"); ok && base != "" {
+		key, unit = base, "_kbps"
+		switch v := value.(type) {
+		case int:
+			value = float64(v) / 1000
+		case float64:
+			value = v / 1000
+		}
+	} else if bweStatsMs[key] {
+		unit = "_ms"
+	}
+
+	name := strings.Builder{}
+	name.WriteString(estimator + "_")
+	for _, r := range key {
+		if unicode.IsUpper(r) {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToLower(r))
+	}
+	return name.String() + unit, value
+}
+
+// bweSample is the estimator state of one connection at one tick
+type bweSample struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Experiment string    `json:"experiment"`
+	Room       string    `json:"room"`
+	Peer       string    `json:"peer"`
+	Estimator  string    `json:"estimator"`
+	TargetKbps float64   `json:"target_kbps"`
+	// RTT from the receiver reports of what we send
+	RTTMs float64 `json:"rtt_ms"`
+
+	// Stats of the active estimator, named by bweStatColumn
+	Stats map[string]interface{} `json:"stats"`
+	// ShadowTargetsKbps are written as shadow_target_kbps_<name> columns in CSV
+	ShadowTargetsKbps map[string]float64 `json:"shadow_target_kbps,omitempty"`
+
+	// columns and shadows order the stats and shadow columns
+	columns []string
+	shadows []string
+}
+
+func (s *bweSample) row() []string {
+	row := []string{
+		s.Timestamp.Format(time.RFC3339Nano), s.Experiment, s.Room, s.Peer, s.Estimator,
+		formatNumber(s.TargetKbps), formatNumber(s.RTTMs),
+	}
+	for _, column := range s.columns {
+		switch v := s.Stats[column].(type) {
+		case float64:
+			row = append(row, formatNumber(v))
+		case nil:
+			row = append(row, "")
+		default:
+			row = append(row, fmt.Sprint(v))
+		}
+	}
+	for _, name := range s.shadows {
+		row = append(row, formatNumber(s.ShadowTargetsKbps[name]))
+	}
+	return row
+}
+
+// bweRecorder samples the estimator of one connection every tick. Samples are written to
+// <room>-<peer>-bwe.csv or .jsonl in the session directory with wall clock timestamps, so they
+// line up with the tc scripts.
+type bweRecorder struct {
+	experiment string
+	room       string
+	peer       string
+	name       string
+	estimator  cc.BandwidthEstimator
+	// columns of the estimator's stats and names of the shadows, fixed for the session
+	columns []string
+	shadows []string
+
+	mu     sync.Mutex
+	last   *bweSnapshot
+	export *statsExporter
+}
+
+func newBWERecorder(dir, experiment, room, peer, name string, estimator cc.BandwidthEstimator) (*bweRecorder, error) {
+	r := &bweRecorder{experiment: experiment, room: room, peer: peer, name: name, estimator: estimator}
+
+	// Every estimator returns the same keys each time
+	for key, value := range estimator.GetStats() {
+		column, _ := bweStatColumn(name, key, value)
+		r.columns = append(r.columns, column)
+	}
+	sort.Strings(r.columns)
+	header := append(append([]string{}, bweColumns...), r.columns...)
+	if e, ok := estimator.(*shadowedEstimator); ok {
+		for _, shadow := range e.shadows {
+			r.shadows = append(r.shadows, shadow.name)
+			header = append(header, "shadow_target_kbps_"+shadow.name)
+		}
+	}
+
+	var err error
+	if r.export, err = newStatsExporter(dir, room, peer, "-bwe", header); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// record takes a snapshot, logs it and keeps it for the API
+func (r *bweRecorder) record(now time.Time, rtt time.Duration) *bweSnapshot {
+	snapshot := &bweSnapshot{
+		Peer:          r.peer,
+		Time:          now,
+		Estimator:     r.name,
+		TargetBitrate: r.estimator.GetTargetBitrate(),
+		RTT:           float64(rtt.Microseconds()) / 1000.0,
+		Stats:         r.estimator.GetStats(),
+	}
+	sample := &bweSample{
+		Timestamp:  now,
+		Experiment: r.experiment,
+		Room:       r.room,
+		Peer:       r.peer,
+		Estimator:  r.name,
+		TargetKbps: float64(snapshot.TargetBitrate) / 1000,
+		RTTMs:      snapshot.RTT,
+		Stats:      map[string]interface{}{},
+		columns:    r.columns,
+		shadows:    r.shadows,
+	}
+	for key, value := range snapshot.Stats {
+		column, converted := bweStatColumn(r.name, key, value)
+		sample.Stats[column] = converted
+	}
+	if e, ok := r.estimator.(*shadowedEstimator); ok {
+		snapshot.Shadows = map[string]map[string]interface{}{}
+		sample.ShadowTargetsKbps = map[string]float64{}
+		for _, shadow := range e.shadows {
+			stats := shadow.estimator.GetStats()
+			stats["targetBitrate"] = shadow.estimator.GetTargetBitrate()
+			snapshot.Shadows[shadow.name] = stats
+			sample.ShadowTargetsKbps[shadow.name] = float64(shadow.estimator.GetTargetBitrate()) / 1000
+		}
+	}
+	r.export.write(sample)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = snapshot
+	return snapshot
+}
+
+// snapshot returns the last recorded snapshot, nil before the first tick
+func (r *bweRecorder) snapshot() *bweSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// Close closes the stats file
+func (r *bweRecorder) Close() {
+	r.export.Close() //nolint: errcheck
+}
+
+// sendRTT averages the round trip time the receiver reports of our outgoing streams carry
+func sendRTT(peerConnection *webrtc.PeerConnection, statsGetter stats.Getter) time.Duration {
+	var total time.Duration
+	count := 0
+	for _, sender := range peerConnection.GetSenders() {
+		if sender.Track() == nil || statsGetter == nil {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			s := statsGetter.Get(uint32(encoding.SSRC))
+			if s == nil || s.RemoteInboundRTPStreamStats.RoundTripTimeMeasurements == 0 {
+				continue
+			}
+			total += s.RemoteInboundRTPStreamStats.RoundTripTime
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
+
+// formatBWEStats renders the stats of a snapshot for the log, in key order
+func formatBWEStats(stats map[string]interface{}) string {
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if v, ok := stats[key].(float64); ok {
+			parts = append(parts, fmt.Sprintf("%s: %.2f", key, v))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s: %v", key, stats[key]))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// bweStatsHandler returns the last estimator snapshot of every connection, or of ?peer= only
+func bweStatsHandler(w http.ResponseWriter, r *http.Request) {
+	peer := r.URL.Query().Get("peer")
+
+	listLock.RLock()
+	snapshots := []*bweSnapshot{}
+	for _, p := range peerConnections {
+		if peer != "" && p.id != peer {
+			continue
+		}
+		if s := p.bwe.snapshot(); s != nil {
+			snapshots = append(snapshots, s)
+		}
+	}
+	listLock.RUnlock()
+
+	if peer != "" && len(snapshots) == 0 {
+		http.Error(w, "unknown peer", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshots); err != nil {
+		mainLogger.Errorf("Failed to encode bwe stats: %v", err)
+	}
+}
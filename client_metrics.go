@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Client metrics older than this are not merged into the stats anymore
+const clientMetricsMaxAge = 5 * time.Second
+
+var errInvalidClientMetrics = errors.New("invalid client metrics")
+
+// clientMetrics is what a client reports about a video it renders, sent as JSON on its
+// metrics data channel. Older clients leave out type and track, their reports are about the
+// only video they receive. The resolution is either "WxH" or width and height.
+type clientMetrics struct {
+	Type string `json:"type,omitempty"`
+	// Track is the ID of the rendered track, which is the ID of our down-track
+	Track string `json:"track,omitempty"`
+	// Timestamp is the client's clock in milliseconds since the epoch
+	Timestamp   int64   `json:"timestamp"`
+	Resolution  string  `json:"resolution,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	FrameRate   float64 `json:"frameRate"`
+	BitrateKbps float64 `json:"bitrateKbps"`
+}
+
+// parseClientMetrics decodes and validates a report, unknown fields are rejected so typos don't go unnoticed
+func parseClientMetrics(raw []byte) (*clientMetrics, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	m := &clientMetrics{}
+	if err := decoder.Decode(m); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidClientMetrics, err)
+	}
+
+	if m.Type != "" && m.Type != "client-metrics" {
+		return nil, fmt.Errorf("%w: type %q is not client-metrics", errInvalidClientMetrics, m.Type)
+	}
+	if m.Resolution != "" {
+		var width, height int
+		if _, err := fmt.Sscanf(m.Resolution, "%dx%d", &width, &height); err != nil {
+			return nil, fmt.Errorf("%w: resolution %q is not WxH", errInvalidClientMetrics, m.Resolution)
+		}
+		if (m.Width != 0 && m.Width != width) || (m.Height != 0 && m.Height != height) {
+			return nil, fmt.Errorf("%w: resolution %q doesn't match width and height", errInvalidClientMetrics, m.Resolution)
+		}
+		m.Width, m.Height = width, height
+	}
+	if m.Width < 0 || m.Height < 0 || m.Width > 16384 || m.Height > 16384 {
+		return nil, fmt.Errorf("%w: resolution %dx%d is out of range", errInvalidClientMetrics, m.Width, m.Height)
+	}
+	if m.FrameRate < 0 || m.FrameRate > 1000 {
+		return nil, fmt.Errorf("%w: frameRate %v is out of range", errInvalidClientMetrics, m.FrameRate)
+	}
+	if m.BitrateKbps < 0 {
+		return nil, fmt.Errorf("%w: bitrateKbps %v is negative", errInvalidClientMetrics, m.BitrateKbps)
+	}
+	m.Type = "client-metrics"
+	return m, nil
+}
+
+// clientReports keeps the latest metrics a client sent about each track it renders
+type clientReports struct {
+	mu     sync.Mutex
+	tracks map[string]clientReport
+}
+
+type clientReport struct {
+	metrics  *clientMetrics
+	received time.Time
+}
+
+func (c *clientReports) update(m *clientMetrics, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tracks == nil {
+		c.tracks = map[string]clientReport{}
+	}
+	// Tracks the client stopped reporting are forgotten
+	for track, r := range c.tracks {
+		if now.Sub(r.received) > clientMetricsMaxAge {
+			delete(c.tracks, track)
+		}
+	}
+	c.tracks[m.Track] = clientReport{metrics: m, received: now}
+}
+
+// latest returns the last report about track unless it is older than clientMetricsMaxAge
+func (c *clientReports) latest(track string, now time.Time) *clientMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.tracks[track]
+	if !ok || now.Sub(r.received) > clientMetricsMaxAge {
+		return nil
+	}
+	return r.metrics
+}
+
+// merge copies the latest report about the down-track of a sample into its client_ fields
+func (c *clientReports) merge(s *outboundSample, now time.Time) {
+	m := c.latest(s.Track, now)
+	if m == nil {
+		return
+	}
+	if m.Width != 0 && m.Height != 0 {
+		s.ClientWidth, s.ClientHeight = &m.Width, &m.Height
+	}
+	s.ClientFrameRate, s.ClientBitrateKbps = &m.FrameRate, &m.BitrateKbps
+}
@@ -0,0 +1,168 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// negotiatedCodecs returns the codecs the remote side accepted for kind.
+// known is false until the first answer from the peer has been applied.
+func negotiatedCodecs(pc *webrtc.PeerConnection, kind webrtc.RTPCodecType) (codecs []webrtc.RTPCodecCapability, known bool) {
+	remote := pc.RemoteDescription()
+	if remote == nil {
+		return nil, false
+	}
+
+	parsed, err := remote.Unmarshal()
+	if err != nil {
+		return nil, false
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != kind.String() || media.MediaName.Port.Value == 0 {
+			continue
+		}
+
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+
+			codec, err := parsed.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil {
+				continue
+			}
+
+			codecs = append(codecs, sdpCodecCapability(kind, codec))
+		}
+	}
+	return codecs, true
+}
+
+func sdpCodecCapability(kind webrtc.RTPCodecType, codec sdp.Codec) webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{
+		MimeType:    kind.String() + "/" + codec.Name,
+		ClockRate:   codec.ClockRate,
+		SDPFmtpLine: codec.Fmtp,
+	}
+}
+
+// codecSupported reports if codec can be decoded by a peer that negotiated the given codecs
+func codecSupported(negotiated []webrtc.RTPCodecCapability, codec webrtc.RTPCodecCapability) bool {
+	for _, c := range negotiated {
+		if !strings.EqualFold(c.MimeType, codec.MimeType) || c.ClockRate != codec.ClockRate {
+			continue
+		}
+
+		switch {
+		case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+			// The profile has to match, levels are negotiated by the decoder
+			if h264Profile(c.SDPFmtpLine) == h264Profile(codec.SDPFmtpLine) &&
+				fmtpValue(c.SDPFmtpLine, "packetization-mode") == fmtpValue(codec.SDPFmtpLine, "packetization-mode") {
+				return true
+			}
+		case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+			if fmtpValue(c.SDPFmtpLine, "profile-id") == fmtpValue(codec.SDPFmtpLine, "profile-id") {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func h264Profile(fmtp string) string {
+	profileLevelID := strings.ToLower(fmtpValue(fmtp, "profile-level-id"))
+	if len(profileLevelID) < 2 {
+		// Baseline is the default when no profile is signaled
+		return "42"
+	}
+	return profileLevelID[:2]
+}
+
+func fmtpValue(fmtp, key string) string {
+	for _, param := range strings.Split(fmtp, ";") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+type trackUnavailable struct {
+	TrackID  string `json:"trackId"`
+	StreamID string `json:"streamId"`
+	Kind     string `json:"kind"`
+	Codec    string `json:"codec"`
+	Reason   string `json:"reason"`
+}
+
+// canReceive checks if a peer that negotiated the given codecs can decode codec. A
+// track-unavailable event is sent the first time a track is skipped. Must hold listLock.
+func (p *peerConnectionState) canReceive(negotiated []webrtc.RTPCodecCapability, trackID, streamID string, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability, hasAlternate bool) bool {
+	if codecSupported(negotiated, codec) {
+		delete(p.unavailable, trackID)
+		return true
+	}
+
+	// Another track of the same publisher is sent instead, nothing to report
+	if hasAlternate || p.unavailable[trackID] {
+		return false
+	}
+	p.unavailable[trackID] = true
+
+	event := trackUnavailable{
+		TrackID:  trackID,
+		StreamID: streamID,
+		Kind:     kind.String(),
+		Codec:    codec.MimeType,
+		Reason:   fmt.Sprintf("codec %s %s was not negotiated by this peer", codec.MimeType, codec.SDPFmtpLine),
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		mainLogger.Errorf("Failed to marshal track-unavailable to json: %v", err)
+		return false
+	}
+
+	mainLogger.Infof("Peer %s can't receive track %s: %s", p.id, trackID, event.Reason)
+	// The websocket is gone during the grace period
+	if p.signalingLost {
+		return false
+	}
+
+	if err = p.websocket.WriteJSON(&websocketMessage{
+		Event: "track-unavailable",
+		Data:  string(data),
+	}); err != nil {
+		mainLogger.Errorf("Failed to write JSON: %v", err)
+	}
+	return false
+}
+
+// answerReceived is called once the peer applied an answer. It reports if tracks were
+// held back because the codecs of the peer weren't known yet.
+func answerReceived(pc *webrtc.PeerConnection) (resync bool) {
+	listLock.Lock()
+	defer listLock.Unlock()
+
+	for _, p := range peerConnections {
+		if p.peerConnection == pc && p.awaitingAnswer {
+			p.awaitingAnswer = false
+			return true
+		}
+	}
+	return false
+}
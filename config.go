@@ -0,0 +1,239 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// serverConfig is loaded from the JSON file passed with -config
+type serverConfig struct {
+	// Codecs every PeerConnection is able to negotiate, in default preference order
+	Codecs []codecConfig `json:"codecs"`
+	// Rooms holds per room overrides, keyed by the room query parameter
+	Rooms map[string]roomConfig `json:"rooms"`
+	// BWE configures the bandwidth estimators
+	BWE bweConfig `json:"bwe"`
+	// ArrivalLog logs every packet publishers send us
+	ArrivalLog arrivalLogConfig `json:"arrivalLog"`
+	// Bitrate tunes the trackers of inbound bitrate
+	Bitrate bitrateConfig `json:"bitrate"`
+	// Stats is where the per session stats are written
+	Stats statsConfig `json:"stats"`
+	// Advice is the bitrate advice sent to clients over their metrics data channel
+	Advice adviceConfig `json:"advice"`
+	// Relay fans data channel messages out to the other participants of a room
+	Relay relayConfig `json:"relay"`
+}
+
+type codecConfig struct {
+	MimeType     string                `json:"mimeType"`
+	ClockRate    uint32                `json:"clockRate"`
+	Channels     uint16                `json:"channels"`
+	PayloadType  uint8                 `json:"payloadType"`
+	SDPFmtpLine  string                `json:"fmtp"`
+	RTCPFeedback []webrtc.RTCPFeedback `json:"rtcpFeedback"`
+}
+
+type roomConfig struct {
+	// CodecPreference lists mime types that are offered before the rest of the catalogue
+	CodecPreference []string `json:"codecPreference"`
+}
+
+var videoRTCPFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb", Parameter: ""}, {Type: "ccm", Parameter: "fir"}, {Type: "nack", Parameter: ""}, {Type: "nack", Parameter: "pli"}, {Type: "transport-cc"}}
+
+// staticPayloadTypes of the codecs with a payload type assigned by RFC 3551, every other
+// codec needs one from the dynamic range
+var staticPayloadTypes = map[string]uint8{
+	strings.ToLower(webrtc.MimeTypePCMU): 0,
+	strings.ToLower(webrtc.MimeTypePCMA): 8,
+	strings.ToLower(webrtc.MimeTypeG722): 9,
+}
+
+// defaultCodecs is used when no catalogue is configured. H264 baseline stays first
+// so existing clients negotiate exactly what they did before.
+func defaultCodecs() []codecConfig {
+	return []codecConfig{
+		{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, PayloadType: 111, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+		// Baseline profile, packetization-mode=1 for compatibility
+		{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, PayloadType: 102, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RTCPFeedback: videoRTCPFeedback},
+		{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, PayloadType: 96, RTCPFeedback: videoRTCPFeedback},
+		{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, PayloadType: 104, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f", RTCPFeedback: videoRTCPFeedback},
+		{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, PayloadType: 106, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", RTCPFeedback: videoRTCPFeedback},
+		{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, PayloadType: 98, SDPFmtpLine: "profile-id=0", RTCPFeedback: videoRTCPFeedback},
+		{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, PayloadType: 100, SDPFmtpLine: "profile-id=2", RTCPFeedback: videoRTCPFeedback},
+		{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, PayloadType: 108, RTCPFeedback: videoRTCPFeedback},
+		{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, PayloadType: 110, RTCPFeedback: videoRTCPFeedback},
+	}
+}
+
+// loadConfig reads the config file at path, an empty path returns the defaults
+func loadConfig(path string) (*serverConfig, error) {
+	cfg := &serverConfig{}
+	if path != "" {
+		raw, err := os.ReadFile(path) //nolint: gosec
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(raw, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+
+	if len(cfg.Codecs) == 0 {
+		cfg.Codecs = defaultCodecs()
+	}
+	cfg.BWE.setDefaults()
+	cfg.ArrivalLog.setDefaults()
+	cfg.Bitrate.setDefaults()
+	cfg.Stats.setDefaults()
+	cfg.Advice.setDefaults()
+	cfg.Relay.setDefaults()
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *serverConfig) validate() error {
+	payloadTypes := map[uint8]string{}
+	codecs := map[string]bool{}
+	for _, codec := range c.Codecs {
+		if _, err := codecKind(codec.MimeType); err != nil {
+			return err
+		}
+		if codec.ClockRate == 0 {
+			return fmt.Errorf("codec %s: clockRate is required", codec.MimeType)
+		}
+		if static, ok := staticPayloadTypes[strings.ToLower(codec.MimeType)]; ok {
+			if codec.PayloadType != static {
+				return fmt.Errorf("codec %s: payload type must be %d", codec.MimeType, static)
+			}
+		} else if codec.PayloadType < 96 || codec.PayloadType > 127 {
+			return fmt.Errorf("codec %s: payload type %d must be in the dynamic range 96-127", codec.MimeType, codec.PayloadType)
+		}
+		if other, ok := payloadTypes[codec.PayloadType]; ok {
+			return fmt.Errorf("codec %s: payload type %d is already used by %s", codec.MimeType, codec.PayloadType, other)
+		}
+		payloadTypes[codec.PayloadType] = codec.MimeType
+
+		key := strings.ToLower(codec.MimeType) + ";" + codec.SDPFmtpLine
+		if codecs[key] {
+			return fmt.Errorf("codec %s with fmtp %q is listed twice", codec.MimeType, codec.SDPFmtpLine)
+		}
+		codecs[key] = true
+	}
+
+	if _, ok := bandwidthEstimators[c.BWE.Default]; !ok {
+		return fmt.Errorf("bwe: %w %q, choose one of %v", errUnknownEstimator, c.BWE.Default, bandwidthEstimatorNames())
+	}
+	if _, err := parseShadows(strings.Join(c.BWE.Shadows, ",")); err != nil {
+		return fmt.Errorf("bwe.shadows: %w", err)
+	}
+	// The trace is read again for every connection, a broken one should fail here and not there
+	if c.BWE.Trace != "" || c.BWE.Default == "trace" || slices.Contains(c.BWE.Shadows, "trace") {
+		if _, err := loadTrace(c.BWE.Trace); err != nil {
+			return fmt.Errorf("bwe.trace: %w", err)
+		}
+	}
+	if err := c.Bitrate.validate(); err != nil {
+		return err
+	}
+	if err := c.Stats.validate(); err != nil {
+		return err
+	}
+	if err := c.Relay.validate(c.Advice.Label, controlLabel); err != nil {
+		return err
+	}
+
+	for name, room := range c.Rooms {
+		if err := validateRoom(name); err != nil {
+			return err
+		}
+		for _, mimeType := range room.CodecPreference {
+			if !c.hasCodec(mimeType) {
+				return fmt.Errorf("room %s: preferred codec %s is not in the catalogue", name, mimeType)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *serverConfig) hasCodec(mimeType string) bool {
+	for _, codec := range c.Codecs {
+		if strings.EqualFold(codec.MimeType, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// codecsForRoom returns the catalogue with the room's preferred codecs moved to the front
+func (c *serverConfig) codecsForRoom(room string) []codecConfig {
+	preference := c.Rooms[room].CodecPreference
+	codecs := make([]codecConfig, 0, len(c.Codecs))
+	for _, mimeType := range preference {
+		for _, codec := range c.Codecs {
+			if strings.EqualFold(codec.MimeType, mimeType) {
+				codecs = append(codecs, codec)
+			}
+		}
+	}
+
+	for _, codec := range c.Codecs {
+		preferred := false
+		for _, mimeType := range preference {
+			preferred = preferred || strings.EqualFold(codec.MimeType, mimeType)
+		}
+		if !preferred {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+func codecKind(mimeType string) (webrtc.RTPCodecType, error) {
+	switch {
+	case strings.HasPrefix(strings.ToLower(mimeType), "audio/"):
+		return webrtc.RTPCodecTypeAudio, nil
+	case strings.HasPrefix(strings.ToLower(mimeType), "video/"):
+		return webrtc.RTPCodecTypeVideo, nil
+	default:
+		return 0, fmt.Errorf("codec %q: mime type must start with audio/ or video/", mimeType)
+	}
+}
+
+// registerCodecs registers the catalogue on m in the preference order of room
+func registerCodecs(m *webrtc.MediaEngine, room string) error {
+	for _, codec := range config.codecsForRoom(room) {
+		kind, err := codecKind(codec.MimeType)
+		if err != nil {
+			return err
+		}
+
+		if err = m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     codec.MimeType,
+				ClockRate:    codec.ClockRate,
+				Channels:     codec.Channels,
+				SDPFmtpLine:  codec.SDPFmtpLine,
+				RTCPFeedback: codec.RTCPFeedback,
+			},
+			PayloadType: webrtc.PayloadType(codec.PayloadType),
+		}, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
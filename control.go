@@ -0,0 +1,193 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// Label of the data channel the server opens to every peer for control commands
+	controlLabel = "control"
+	// How long a connected session outlives its websocket
+	websocketGracePeriod = 30 * time.Second
+)
+
+var (
+	errUnknownTrack  = errors.New("unknown track")
+	errUnknownStream = errors.New("unknown stream")
+	errNotTrackOwner = errors.New("track is published by another peer")
+)
+
+// trackMute stops forwarding a published track while keeping it negotiated
+type trackMute struct {
+	publisher *webrtc.PeerConnection
+	muted     atomic.Bool
+}
+
+// setMuted mutes or unmutes a track the peer behind pc publishes
+func setMuted(pc *webrtc.PeerConnection, trackID string, muted bool) error {
+	listLock.RLock()
+	defer listLock.RUnlock()
+
+	m, ok := trackMutes[trackID]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownTrack, trackID)
+	}
+	if m.publisher != pc {
+		return fmt.Errorf("%w: %s", errNotTrackOwner, trackID)
+	}
+	if m.muted.Swap(muted) && !muted {
+		// Subscribers need a keyframe and continuous sequence numbers to pick the video up again
+		if s, ok := videoSources[trackID]; ok {
+			s.resync()
+		}
+	}
+	return nil
+}
+
+// requestKeyFrames asks the sources behind the peer's down-tracks for a keyframe. An empty
+// trackID requests one for every down-track.
+func requestKeyFrames(pc *webrtc.PeerConnection, trackID string) error {
+	listLock.RLock()
+	defer listLock.RUnlock()
+
+	for _, p := range peerConnections {
+		if p.peerConnection != pc {
+			continue
+		}
+
+		found := false
+		for _, d := range p.downTracks {
+			if trackID != "" && d.track.ID() != trackID {
+				continue
+			}
+			found = true
+			if s := d.currentSource(); s != nil {
+				s.requestKeyFrame()
+			}
+		}
+		if trackID != "" && !found {
+			return fmt.Errorf("%w: %s", errUnknownTrack, trackID)
+		}
+	}
+	return nil
+}
+
+// controlCommand is sent by the client on the control channel. It mirrors the websocket
+// events, ID is echoed in the reply so requests can be matched.
+type controlCommand struct {
+	ID   int64  `json:"id,omitempty"`
+	Type string `json:"type"`
+	// Stream is the publisher stream ID of pin and unpin
+	Stream string `json:"stream,omitempty"`
+	// Track is one of our own tracks for mute, unmute, screen-share and camera, a down-track
+	// for keyframe
+	Track string `json:"track,omitempty"`
+	// Timestamp of a ping on the client's clock, echoed in the pong
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// controlReply answers every command with ok, pong or error
+type controlReply struct {
+	ID         int64  `json:"id,omitempty"`
+	Type       string `json:"type"`
+	Error      string `json:"error,omitempty"`
+	Timestamp  int64  `json:"timestamp,omitempty"`
+	ServerTime int64  `json:"serverTime,omitempty"`
+}
+
+// runControlCommand applies a command of p and returns the reply
+func runControlCommand(p *peerConnectionState, raw []byte) *controlReply {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	cmd := &controlCommand{}
+	if err := decoder.Decode(cmd); err != nil {
+		return &controlReply{Type: "error", Error: fmt.Sprintf("invalid command: %v", err)}
+	}
+
+	var err error
+	reply := &controlReply{ID: cmd.ID, Type: "ok"}
+	switch cmd.Type {
+	case "pin", "unpin":
+		if cmd.Stream == "" {
+			err = errors.New("stream is required")
+			break
+		}
+		err = setPinned(p.peerConnection, cmd.Stream, cmd.Type == "pin")
+	case "mute", "unmute":
+		err = setMuted(p.peerConnection, cmd.Track, cmd.Type == "mute")
+	case "screen-share", "camera":
+		err = setScreenShare(p.peerConnection, cmd.Track, cmd.Type == "screen-share")
+	case "keyframe":
+		err = requestKeyFrames(p.peerConnection, cmd.Track)
+	case "ping":
+		reply.Type, reply.Timestamp, reply.ServerTime = "pong", cmd.Timestamp, time.Now().UnixMilli()
+	default:
+		err = fmt.Errorf("unknown command %q", cmd.Type)
+	}
+	if err != nil {
+		reply.Type, reply.Error = "error", err.Error()
+	}
+	return reply
+}
+
+// openControlChannel opens the control channel of p. It has to happen before the first offer
+// so the SCTP association is negotiated even if the client opens no channel itself.
+func openControlChannel(p *peerConnectionState) {
+	d, err := p.peerConnection.CreateDataChannel(controlLabel, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		reply := runControlCommand(p, msg.Data)
+		if reply.Type == "error" {
+			mainLogger.Warnf("Control command of peer %s failed: %s: %s", p.id, msg.Data, reply.Error)
+		}
+
+		data, err := json.Marshal(reply)
+		if err != nil {
+			mainLogger.Errorf("Failed to marshal control reply: %v", err)
+			return
+		}
+		if err = d.SendText(string(data)); err != nil {
+			mainLogger.Errorf("❌ SERVER: Failed to send message on DataChannel '%s': %v", d.Label(), err)
+		}
+	})
+}
+
+// keepSession holds the session of p for websocketGracePeriod after its websocket is gone, the
+// client can still control it on the control channel. It returns early when the PeerConnection
+// closes, and at once if it isn't connected.
+func keepSession(p *peerConnectionState, closed <-chan struct{}) {
+	if p.peerConnection.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		return
+	}
+
+	// Offers can't be answered anymore, the tracks the peer gets stay as they are
+	listLock.Lock()
+	p.signalingLost = true
+	listLock.Unlock()
+	p.websocket.Close() //nolint
+	mainLogger.Infof("Websocket of peer %s is gone, keeping its session for %v", p.id, websocketGracePeriod)
+
+	timer := time.NewTimer(websocketGracePeriod)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		mainLogger.Infof("Grace period of peer %s is over, closing its session", p.id)
+	case <-closed:
+	}
+}
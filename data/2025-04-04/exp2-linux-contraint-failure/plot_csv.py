@@ -1,17 +1,19 @@
+import sys
+
 import pandas as pd
 import matplotlib.pyplot as plt
 import numpy as np
 
 def plot_bitrate(csv_file, reference_bitrate_file):
     # Read the main CSV file
-    df = pd.read_csv(csv_file, parse_dates=['Timestamp'])
-    df['Timestamp'] = (df['Timestamp'] - df['Timestamp'].min()).dt.total_seconds()
+    df = pd.read_csv(csv_file, parse_dates=['timestamp'])
+    df['timestamp'] = (df['timestamp'] - df['timestamp'].min()).dt.total_seconds()
 
     # Read the reference bitrate CSV file
     ref_df = pd.read_csv(reference_bitrate_file)
 
     # Filter only video data
-    video_df = df[df['Kind'] == 'video']
+    video_df = df[df['kind'] == 'video']
     fig, ax1 = plt.subplots(figsize=(12, 6))
 
     # Repeat the reference bitrate values to match the length of the CurrentBitrate plot
@@ -19,11 +21,11 @@ def plot_bitrate(csv_file, reference_bitrate_file):
     repeated_ref_bitrate = repeated_ref_bitrate[:len(video_df)]  # Trim to match the exact length
 
     # Plot the repeated reference bitrate
-    ax1.plot(video_df['Timestamp'], repeated_ref_bitrate, label='Reference Bitrate', linestyle='-.', color='#601A4A', alpha=0.5)
+    ax1.plot(video_df['timestamp'], repeated_ref_bitrate, label='Reference Bitrate', linestyle='-.', color='#601A4A', alpha=0.5)
 
     # Plot CurrentBitrate and TargetBitrate for Video on primary y-axis
-    ax1.plot(video_df['Timestamp'], video_df['CurrentBitrate'], label='CurrentBitrate (Video)', color='#63ACBE')
-    ax1.plot(video_df['Timestamp'], video_df['TargetBitrate'], label='TargetBitrate (Video)', linestyle='--', color='#EE442F')
+    ax1.plot(video_df['timestamp'], video_df['received_kbps'], label='CurrentBitrate (Video)', color='#63ACBE')
+    ax1.plot(video_df['timestamp'], video_df['target_kbps'], label='TargetBitrate (Video)', linestyle='--', color='#EE442F')
 
 
     ax1.set_xlabel('Timestamp')
@@ -38,9 +40,9 @@ def plot_bitrate(csv_file, reference_bitrate_file):
     # ax1.vlines(x=720, ymin=15_000, ymax=30_000, colors='grey', linestyles='solid', alpha=0.8)
     # ax1.hlines(y=30_000, xmin=720, xmax=960, colors='grey', linestyles='solid', alpha=0.8)
     # ax1.vlines(x=960, ymin=30_000, ymax=100_000, colors='grey', linestyles='solid', alpha=0.8)
-    # ax1.hlines(y=100_000, xmin=960, xmax=video_df['Timestamp'].max(), colors='grey', linestyles='solid', alpha=0.8)
+    # ax1.hlines(y=100_000, xmin=960, xmax=video_df['timestamp'].max(), colors='grey', linestyles='solid', alpha=0.8)
     # ax1.vlines(x=960, ymin=10_000, ymax=30_000, colors='grey', linestyles='solid', alpha=0.8)
-    # ax1.hlines(y=30_000, xmin=960, xmax=video_df['Timestamp'].max(), colors='grey', linestyles='solid', alpha=0.8)
+    # ax1.hlines(y=30_000, xmin=960, xmax=video_df['timestamp'].max(), colors='grey', linestyles='solid', alpha=0.8)
         # ax1.vlines(x=600, ymin=3000, ymax=10_000, colors='grey', linestyles='solid', alpha=0.8)
         # ax1.hlines(y=10_000, xmin=600, xmax=720, colors='grey', linestyles='solid', alpha=0.8)
         # ax1.vlines(x=720, ymin=10_000, ymax=50_000, colors='grey', linestyles='solid', alpha=0.8)
@@ -48,7 +50,7 @@ def plot_bitrate(csv_file, reference_bitrate_file):
 
     # Secondary y-axis for PacketsReceived
     ax2 = ax1.twinx()
-    ax2.plot(video_df['Timestamp'], video_df['Jitter'], label='Jitter', color='#131a78', linestyle='solid', alpha=0.2)
+    ax2.plot(video_df['timestamp'], video_df['jitter_ms'], label='Jitter', color='#131a78', linestyle='solid', alpha=0.2)
     ax2.set_ylabel('Jitter (ms)')
     ax2.tick_params(axis='y')
     ax2.set_ylim(0, 400)
@@ -71,4 +73,5 @@ def plot_bitrate(csv_file, reference_bitrate_file):
     plt.show()
 
 # Example usage
-plot_bitrate('app.csv', 'bitrate_data_nyu.csv')
\ No newline at end of file
+# The per session stats of a peer, data/<date>/<experiment>/<room>-<peer id>.csv
+plot_bitrate(sys.argv[1], 'bitrate_data_nyu.csv')
\ No newline at end of file
@@ -0,0 +1,205 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// adviceConfig configures the bitrate advice pushed to clients over their metrics data channel
+type adviceConfig struct {
+	// Label of the data channel clients open for metrics
+	Label string `json:"label"`
+	// Interval between two advices in milliseconds, negative disables them
+	Interval int `json:"interval"`
+}
+
+func (c *adviceConfig) setDefaults() {
+	if c.Label == "" {
+		c.Label = "metricsChannel"
+	}
+	if c.Interval == 0 {
+		c.Interval = 1000
+	}
+}
+
+// bitrateAdvice is what the server knows about a connection, for the client to adapt its
+// encoders to. Bitrates are in bits per second, RTT in milliseconds.
+type bitrateAdvice struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	// TargetBitrate is the estimate of what we can send the client
+	TargetBitrate int `json:"targetBitrate"`
+	// ReceiveBitrate is what we receive from the client, UplinkEstimate what we think it could send
+	ReceiveBitrate int `json:"receiveBitrate"`
+	UplinkEstimate int `json:"uplinkEstimate"`
+	// Loss is the fraction of the client's packets lost since the previous advice
+	Loss float64 `json:"loss"`
+	RTT  float64 `json:"rtt"`
+	// MaxSendBitrate is the most the client should send, the lower of its uplink estimate and
+	// what its subscribers can take. 0 when neither is known yet.
+	MaxSendBitrate int `json:"maxSendBitrate"`
+}
+
+// bitrateAdvisor builds the advices of one connection
+type bitrateAdvisor struct {
+	p *peerConnectionState
+
+	lastReceived uint64
+	lastLost     int64
+}
+
+// advise collects the current advice. Must hold listLock.
+func (a *bitrateAdvisor) advise(now time.Time) *bitrateAdvice {
+	p := a.p
+	advice := &bitrateAdvice{
+		Type:           "bitrate-advice",
+		Timestamp:      now.UnixMilli(),
+		TargetBitrate:  p.estimator.GetTargetBitrate(),
+		UplinkEstimate: p.uplink.GetEstimate(),
+	}
+
+	for _, bitrate := range p.trackers.stats() {
+		advice.ReceiveBitrate += int(bitrate.Bitrate)
+	}
+
+	var received uint64
+	var lost int64
+	for _, receiver := range p.peerConnection.GetReceivers() {
+		if receiver.Track() == nil {
+			continue
+		}
+		if s := p.statsGetter.Get(uint32(receiver.Track().SSRC())); s != nil {
+			received += s.InboundRTPStreamStats.PacketsReceived
+			lost += s.InboundRTPStreamStats.PacketsLost
+		}
+	}
+	if expected := int64(received-a.lastReceived) + lost - a.lastLost; expected > 0 {
+		advice.Loss = max(0, float64(lost-a.lastLost)/float64(expected))
+	}
+	a.lastReceived, a.lastLost = received, lost
+
+	// Subscribers report RTT in receiver reports, publishers only have the ICE checks
+	if rtt := sendRTT(p.peerConnection, p.statsGetter); rtt != 0 {
+		advice.RTT = float64(rtt.Microseconds()) / 1000.0
+	} else {
+		_, advice.RTT = selectedCandidatePair(p.peerConnection.GetStats())
+	}
+
+	for _, limit := range []int{advice.UplinkEstimate, p.subscriberCap} {
+		if limit > 0 && (advice.MaxSendBitrate == 0 || limit < advice.MaxSendBitrate) {
+			advice.MaxSendBitrate = limit
+		}
+	}
+	return advice
+}
+
+// handleDataChannel serves a data channel the client opened
+func handleDataChannel(p *peerConnectionState, d *webrtc.DataChannel) {
+	mainLogger.Infof("✅ SERVER: New DataChannel '%s'-%d created by remote peer\n", d.Label(), d.ID())
+
+	closed := make(chan struct{})
+
+	// Handle when the data channel is opened
+	d.OnOpen(func() {
+		mainLogger.Infof("✅ SERVER: DataChannel '%s'-%d is open\n", d.Label(), d.ID())
+
+		if d.Label() == config.Advice.Label && config.Advice.Interval > 0 {
+			go sendAdvice(p, d, closed)
+		}
+	})
+
+	// Handle incoming messages on the data channel
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if _, ok := config.Relay.Labels[d.Label()]; ok {
+			relayMessage(p, d, msg)
+			return
+		}
+
+		receivedMsg := string(msg.Data)
+		mainLogger.Infof("✅ SERVER: Received message on DataChannel '%s': %s\n", d.Label(), receivedMsg) // Log received message
+
+		// Check if the message is "hello world" and send reply
+		if receivedMsg == "hello world" {
+			replyMsg := "hello world accepted"
+			mainLogger.Infof("✅ SERVER: Sending reply: '%s'\n", replyMsg) // Log sending reply
+			if err := d.SendText(replyMsg); err != nil {
+				mainLogger.Errorf("❌ SERVER: Failed to send message on DataChannel '%s': %v", d.Label(), err)
+			}
+		} else if d.Label() == config.Advice.Label {
+			receiveClientMetrics(p, d, msg.Data)
+		} else {
+			mainLogger.Infof("✅ SERVER: Received unexpected message: '%s'\n", receivedMsg)
+		}
+	})
+
+	// Handle when the data channel is closed
+	d.OnClose(func() {
+		mainLogger.Infof("❌ SERVER: DataChannel '%s'-%d is closed\n", d.Label(), d.ID())
+		close(closed)
+	})
+
+	// Handle errors on the data channel
+	d.OnError(func(err error) {
+		mainLogger.Errorf("❌ SERVER: DataChannel '%s'-%d Error: %v\n", d.Label(), d.ID(), err)
+	})
+}
+
+// receiveClientMetrics stores a report from the metrics channel, invalid ones are answered with an error
+func receiveClientMetrics(p *peerConnectionState, d *webrtc.DataChannel, raw []byte) {
+	m, err := parseClientMetrics(raw)
+	if err == nil && m.Track == "" {
+		// Without a track the report can only be about the one video the peer receives
+		listLock.RLock()
+		if len(p.downTracks) == 1 {
+			m.Track = p.downTracks[0].track.ID()
+		} else {
+			err = fmt.Errorf("%w: track is required when receiving %d videos", errInvalidClientMetrics, len(p.downTracks))
+		}
+		listLock.RUnlock()
+	}
+	if err != nil {
+		mainLogger.Warnf("Rejected client metrics of peer %s: %v", p.id, err)
+		reply, _ := json.Marshal(map[string]string{"type": "error", "error": err.Error()})
+		if err = d.SendText(string(reply)); err != nil {
+			mainLogger.Errorf("❌ SERVER: Failed to send message on DataChannel '%s': %v", d.Label(), err)
+		}
+		return
+	}
+	p.client.update(m, time.Now())
+}
+
+// sendAdvice pushes a bitrateAdvice every interval until the channel closes
+func sendAdvice(p *peerConnectionState, d *webrtc.DataChannel, closed <-chan struct{}) {
+	advisor := &bitrateAdvisor{p: p}
+	ticker := time.NewTicker(time.Duration(config.Advice.Interval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case now := <-ticker.C:
+			listLock.RLock()
+			advice := advisor.advise(now)
+			listLock.RUnlock()
+
+			data, err := json.Marshal(advice)
+			if err != nil {
+				mainLogger.Errorf("Failed to marshal bitrate advice: %v", err)
+				continue
+			}
+			if err = d.SendText(string(data)); err != nil {
+				mainLogger.Errorf("Failed to send bitrate advice on DataChannel '%s': %v", d.Label(), err)
+				return
+			}
+		}
+	}
+}
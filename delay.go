@@ -0,0 +1,192 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// absCaptureTimeURI is not in pion/sdp yet
+	absCaptureTimeURI = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+
+	// The base delay is the minimum over one to two windows, so clock drift can't pile up
+	delayBaseWindow = 10 * time.Second
+)
+
+// ntpEpoch is where NTP timestamps start counting
+var ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func ntpToTime(ntp uint64) time.Time {
+	seconds := ntp >> 32
+	fraction := ntp & 0xffffffff
+	return ntpEpoch.Add(time.Duration(seconds)*time.Second + time.Duration(fraction*uint64(time.Second)>>32))
+}
+
+// PacketDelay is what we know about the one-way delay of the packets of an SSRC
+type PacketDelay struct {
+	// Relative is the delay above the lowest recently seen, from the RTP timestamp mapped to
+	// the sender's clock through its sender reports. Only changes in it are meaningful.
+	Relative time.Duration
+	// Send is the delay since abs-send-time, Capture since abs-capture-time. Both need the
+	// clocks of sender and SFU to be synchronized, and are only valid when the Has flag is set.
+	Send       time.Duration
+	HasSend    bool
+	Capture    time.Duration
+	HasCapture bool
+}
+
+// Packet Delay Calculator
+type PacketDelayCalculator interface {
+	CalculateDelay(packet *rtp.Packet, arrival time.Time) time.Duration
+}
+
+// delayStream is the delay state of one inbound SSRC
+type delayStream struct {
+	clockRate        uint32
+	absSendTimeID    uint8
+	absCaptureTimeID uint8
+
+	// RTP timestamp to sender time, from the last sender report or the first packet before one arrives
+	refRTP  uint32
+	refTime time.Time
+	fromSR  bool
+	hasRef  bool
+
+	// minimum of the raw delay in the current and the previous window
+	minCurrent  time.Duration
+	minPrevious time.Duration
+	windowStart time.Time
+
+	delay PacketDelay
+}
+
+// PacketDelayCalculatorImpl measures the one-way delay of inbound packets per SSRC
+type PacketDelayCalculatorImpl struct {
+	mu      sync.Mutex
+	streams map[uint32]*delayStream
+}
+
+// NewPacketDelayCalculator creates a new PacketDelayCalculator
+func NewPacketDelayCalculator() *PacketDelayCalculatorImpl {
+	return &PacketDelayCalculatorImpl{streams: map[uint32]*delayStream{}}
+}
+
+// AddStream starts measuring an SSRC, with the clock rate and header extensions of its track
+func (p *PacketDelayCalculatorImpl) AddStream(ssrc uint32, clockRate uint32, extensions []webrtc.RTPHeaderExtensionParameter) {
+	s := &delayStream{clockRate: clockRate}
+	for _, ext := range extensions {
+		switch ext.URI {
+		case sdp.ABSSendTimeURI:
+			s.absSendTimeID = uint8(ext.ID)
+		case absCaptureTimeURI:
+			s.absCaptureTimeID = uint8(ext.ID)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.streams[ssrc] = s
+}
+
+// RemoveStream stops measuring an SSRC
+func (p *PacketDelayCalculatorImpl) RemoveStream(ssrc uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.streams, ssrc)
+}
+
+// OnSenderReport maps RTP timestamps of the reported SSRC to the sender's wall clock
+func (p *PacketDelayCalculatorImpl) OnSenderReport(sr *rtcp.SenderReport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.streams[sr.SSRC]
+	if !ok {
+		return
+	}
+
+	// The first mapping came from our own clock, its base delay means nothing on the sender's
+	if !s.fromSR {
+		s.windowStart = time.Time{}
+	}
+	s.refRTP, s.refTime, s.fromSR, s.hasRef = sr.RTPTime, ntpToTime(sr.NTPTime), true, true
+}
+
+// CalculateDelay updates the delay of the packet's SSRC and returns its relative delay
+func (p *PacketDelayCalculatorImpl) CalculateDelay(packet *rtp.Packet, arrival time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.streams[packet.SSRC]
+	if !ok || s.clockRate == 0 {
+		return 0
+	}
+
+	if !s.hasRef {
+		s.refRTP, s.refTime, s.hasRef = packet.Timestamp, arrival, true
+	}
+	elapsed := time.Duration(int64(int32(packet.Timestamp-s.refRTP)) * int64(time.Second) / int64(s.clockRate))
+	raw := arrival.Sub(s.refTime.Add(elapsed))
+
+	if s.windowStart.IsZero() {
+		s.minCurrent, s.minPrevious, s.windowStart = raw, raw, arrival
+	} else if arrival.Sub(s.windowStart) > delayBaseWindow {
+		s.minPrevious, s.minCurrent, s.windowStart = s.minCurrent, raw, arrival
+	}
+	s.minCurrent = min(s.minCurrent, raw)
+	s.delay.Relative = raw - min(s.minCurrent, s.minPrevious)
+
+	if s.absSendTimeID != 0 {
+		if payload := packet.GetExtension(s.absSendTimeID); payload != nil {
+			ext := rtp.AbsSendTimeExtension{}
+			if err := ext.Unmarshal(payload); err == nil {
+				s.delay.Send, s.delay.HasSend = arrival.Sub(ext.Estimate(arrival)), true
+			}
+		}
+	}
+	if s.absCaptureTimeID != 0 {
+		if payload := packet.GetExtension(s.absCaptureTimeID); payload != nil {
+			ext := rtp.AbsCaptureTimeExtension{}
+			if err := ext.Unmarshal(payload); err == nil {
+				capture := ext.CaptureTime()
+				if offset := ext.EstimatedCaptureClockOffsetDuration(); offset != nil {
+					capture = capture.Add(*offset)
+				}
+				s.delay.Capture, s.delay.HasCapture = arrival.Sub(capture), true
+			}
+		}
+	}
+
+	return s.delay.Relative
+}
+
+// GetDelay returns the latest delays of an SSRC
+func (p *PacketDelayCalculatorImpl) GetDelay(ssrc uint32) PacketDelay {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s, ok := p.streams[ssrc]; ok {
+		return s.delay
+	}
+	return PacketDelay{}
+}
+
+// optionalMillis formats a delay in milliseconds for the stats CSV, empty when it is not known
+func optionalMillis(d time.Duration, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return strconv.FormatFloat(float64(d.Microseconds())/1000.0, 'f', 2, 64)
+}
@@ -0,0 +1,292 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// videoSource is an inbound video track that can be forwarded to down-tracks
+type videoSource struct {
+	id        string
+	streamID  string
+	room      string
+	codec     webrtc.RTPCodecCapability
+	ssrc      uint32
+	publisher *webrtc.PeerConnection
+	created   time.Time
+
+	// screenShare is set by the publisher, it gets the same priority as pinned sources
+	screenShare atomic.Bool
+
+	bytes       atomic.Uint64
+	lastBytes   uint64
+	lastSample  time.Time
+	bitrate     int
+	bitrateLock sync.Mutex
+
+	mu         sync.RWMutex
+	downTracks []*downTrack
+}
+
+func newVideoSource(t *webrtc.TrackRemote, publisher *webrtc.PeerConnection, room string) *videoSource {
+	return &videoSource{
+		id:        t.ID(),
+		streamID:  t.StreamID(),
+		room:      room,
+		codec:     t.Codec().RTPCodecCapability,
+		ssrc:      uint32(t.SSRC()),
+		publisher: publisher,
+		created:   time.Now(),
+	}
+}
+
+// forward writes an inbound packet to every down-track currently showing this source
+func (s *videoSource) forward(pkt *rtp.Packet) {
+	s.bytes.Add(uint64(pkt.MarshalSize()))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, d := range s.downTracks {
+		if err := d.writeRTP(s, pkt); err != nil {
+			mainLogger.Debugf("Failed to write to down-track %s: %v", d.track.ID(), err)
+		}
+	}
+}
+
+// sampleBitrate updates the inbound bitrate of the source from the bytes forwarded since the last call
+func (s *videoSource) sampleBitrate(now time.Time) {
+	s.bitrateLock.Lock()
+	defer s.bitrateLock.Unlock()
+
+	bytes := s.bytes.Load()
+	if !s.lastSample.IsZero() {
+		if elapsed := now.Sub(s.lastSample).Seconds(); elapsed > 0 {
+			s.bitrate = int(float64(bytes-s.lastBytes) * 8 / elapsed)
+		}
+	}
+	s.lastBytes, s.lastSample = bytes, now
+}
+
+// getBitrate returns the inbound bitrate in bits per second
+func (s *videoSource) getBitrate() int {
+	s.bitrateLock.Lock()
+	defer s.bitrateLock.Unlock()
+	return s.bitrate
+}
+
+// requestKeyFrame asks the publisher of this source for a new keyframe
+func (s *videoSource) requestKeyFrame() {
+	_ = s.publisher.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: s.ssrc},
+	})
+}
+
+// resync lets every down-track continue seamlessly after the source stopped for a while, used on unmute
+func (s *videoSource) resync() {
+	s.mu.RLock()
+	for _, d := range s.downTracks {
+		d.mu.Lock()
+		d.switching = true
+		d.mu.Unlock()
+	}
+	s.mu.RUnlock()
+	s.requestKeyFrame()
+}
+
+func (s *videoSource) attach(d *downTrack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.downTracks = append(s.downTracks, d)
+}
+
+func (s *videoSource) detach(d *downTrack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.downTracks {
+		if s.downTracks[i] == d {
+			s.downTracks = append(s.downTracks[:i], s.downTracks[i+1:]...)
+			return
+		}
+	}
+}
+
+// detachAll disconnects every down-track from this source, used when the publisher goes away
+func (s *videoSource) detachAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.downTracks {
+		d.mu.Lock()
+		if d.source == s {
+			d.source = nil
+		}
+		d.mu.Unlock()
+	}
+	s.downTracks = nil
+}
+
+// downTrack forwards one video source at a time to a single subscriber. The
+// source can be swapped without renegotiation, sequence numbers and timestamps
+// are rewritten so the subscriber sees one continuous stream.
+type downTrack struct {
+	track  *webrtc.TrackLocalStaticRTP
+	sender *webrtc.RTPSender
+
+	mu        sync.Mutex
+	source    *videoSource
+	paused    bool
+	switching bool
+	started   bool
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+func newDownTrack(track *webrtc.TrackLocalStaticRTP, sender *webrtc.RTPSender) *downTrack {
+	d := &downTrack{track: track, sender: sender}
+
+	// Read incoming RTCP packets, forward keyframe requests to whoever we are showing
+	go func() {
+		for {
+			pkts, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+
+			for _, pkt := range pkts {
+				switch pkt.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					if s := d.currentSource(); s != nil {
+						s.requestKeyFrame()
+					}
+				}
+			}
+		}
+	}()
+
+	return d
+}
+
+func (d *downTrack) currentSource() *videoSource {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.source
+}
+
+// setSource switches the down-track to a new source, nil pauses it
+func (d *downTrack) setSource(s *videoSource) {
+	d.mu.Lock()
+	old := d.source
+	if old == s {
+		d.mu.Unlock()
+		return
+	}
+	d.source = s
+	d.switching = true
+	d.mu.Unlock()
+
+	if old != nil {
+		old.detach(d)
+	}
+	if s != nil {
+		s.attach(d)
+		s.requestKeyFrame()
+	}
+}
+
+// setPaused stops or resumes forwarding without changing the source, used by the bandwidth allocator
+func (d *downTrack) setPaused(paused bool) {
+	d.mu.Lock()
+	if d.paused == paused {
+		d.mu.Unlock()
+		return
+	}
+	d.paused = paused
+	d.switching = true
+	s := d.source
+	d.mu.Unlock()
+
+	if !paused && s != nil {
+		s.requestKeyFrame()
+	}
+}
+
+func (d *downTrack) isPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+// compatible reports if the source can be sent without renegotiating the codec
+func (d *downTrack) compatible(s *videoSource) bool {
+	codec := d.track.Codec()
+	return codec.MimeType == s.codec.MimeType && codec.SDPFmtpLine == s.codec.SDPFmtpLine
+}
+
+func (d *downTrack) writeRTP(s *videoSource, pkt *rtp.Packet) error {
+	seq, ts, ok := d.rewrite(s, pkt, time.Now())
+	if !ok {
+		return nil
+	}
+
+	out := *pkt
+	out.Header.SequenceNumber = seq
+	out.Header.Timestamp = ts
+	return d.track.WriteRTP(&out)
+}
+
+// rewrite returns the sequence number and timestamp a packet of s is sent with, ok is false
+// if it isn't sent at all
+func (d *downTrack) rewrite(s *videoSource, pkt *rtp.Packet, now time.Time) (seq uint16, ts uint32, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.source != s || d.paused {
+		return 0, 0, false
+	}
+
+	// After a switch the subscriber can't decode anything before a keyframe of the new source
+	if d.switching && !isKeyFrame(d.track.Codec().MimeType, pkt.Payload) {
+		return 0, 0, false
+	}
+
+	first := d.switching
+	if d.switching {
+		// Continue right after the last packet we sent, advancing the timestamp
+		// by the wall clock time that passed while switching
+		if d.started {
+			gap := uint32(now.Sub(d.lastWrite).Seconds() * float64(d.track.Codec().ClockRate))
+			if gap == 0 {
+				gap = 1
+			}
+			d.seqOffset = pkt.SequenceNumber - d.lastSeq - 1
+			d.tsOffset = pkt.Timestamp - d.lastTS - gap
+		} else {
+			d.seqOffset, d.tsOffset = 0, 0
+		}
+		d.switching = false
+		d.started = true
+	}
+
+	seq = pkt.SequenceNumber - d.seqOffset
+	ts = pkt.Timestamp - d.tsOffset
+	if diff := seq - d.lastSeq; first || (diff != 0 && diff < 1<<15) {
+		d.lastSeq, d.lastTS, d.lastWrite = seq, ts, now
+	}
+	return seq, ts, true
+}
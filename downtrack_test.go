@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	testVP8KeyFrame   = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}
+	testVP8InterFrame = []byte{0x10, 0x01, 0x00}
+)
+
+// testPacket is a packet of source arriving at after the start of the test. switchTo and
+// pause are applied to the down-track right before it.
+type testPacket struct {
+	at       time.Duration
+	source   int
+	seq      uint16
+	ts       uint32
+	key      bool
+	switchTo *int
+	pause    *bool
+
+	// what the down-track should send, drop if nothing
+	wantSeq uint16
+	wantTS  uint32
+	drop    bool
+}
+
+func testSource(i int) *int { return &i }
+
+func testPaused(p bool) *bool { return &p }
+
+func TestDownTrackRewrite(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		packets []testPacket
+	}{
+		{
+			name: "first source waits for a keyframe and passes unchanged",
+			packets: []testPacket{
+				{seq: 99, ts: 900, drop: true},
+				{seq: 100, ts: 1000, key: true, wantSeq: 100, wantTS: 1000},
+				{seq: 101, ts: 1000, wantSeq: 101, wantTS: 1000},
+			},
+		},
+		{
+			name: "switch continues right after the last packet at its keyframe",
+			packets: []testPacket{
+				{seq: 100, ts: 1000, key: true, wantSeq: 100, wantTS: 1000},
+				{at: 33 * time.Millisecond, seq: 101, ts: 4000, wantSeq: 101, wantTS: 4000},
+				{at: 40 * time.Millisecond, source: 1, switchTo: testSource(1), seq: 5000, ts: 70000, drop: true},
+				// 67ms later, 6030 ticks at 90kHz
+				{at: 100 * time.Millisecond, source: 1, seq: 5001, ts: 73000, key: true, wantSeq: 102, wantTS: 10030},
+				{at: 133 * time.Millisecond, source: 1, seq: 5002, ts: 76000, wantSeq: 103, wantTS: 13030},
+			},
+		},
+		{
+			name: "sequence numbers and timestamps wrap",
+			packets: []testPacket{
+				{seq: 65534, ts: 4294967000, key: true, wantSeq: 65534, wantTS: 4294967000},
+				{seq: 65535, ts: 4294967000, wantSeq: 65535, wantTS: 4294967000},
+				{source: 1, switchTo: testSource(1), seq: 20, ts: 70000, key: true, wantSeq: 0, wantTS: 4294967001},
+				{source: 1, seq: 21, ts: 73000, wantSeq: 1, wantTS: 2705},
+			},
+		},
+		{
+			name: "packets of the previous source are dropped",
+			packets: []testPacket{
+				{seq: 100, ts: 1000, key: true, wantSeq: 100, wantTS: 1000},
+				{source: 1, switchTo: testSource(1), seq: 7, ts: 70000, key: true, wantSeq: 101, wantTS: 1001},
+				{seq: 101, ts: 4000, drop: true},
+				{source: 1, seq: 8, ts: 70000, wantSeq: 102, wantTS: 1001},
+			},
+		},
+		{
+			name: "late packets don't move the next switch back",
+			packets: []testPacket{
+				{seq: 100, ts: 1000, key: true, wantSeq: 100, wantTS: 1000},
+				{seq: 102, ts: 4000, wantSeq: 102, wantTS: 4000},
+				{seq: 101, ts: 1000, wantSeq: 101, wantTS: 1000},
+				{source: 1, switchTo: testSource(1), seq: 9, ts: 70000, key: true, wantSeq: 103, wantTS: 4001},
+			},
+		},
+		{
+			name: "pause drops everything, resume waits for a keyframe",
+			packets: []testPacket{
+				{seq: 10, ts: 100, key: true, wantSeq: 10, wantTS: 100},
+				{seq: 11, ts: 200, key: true, pause: testPaused(true), drop: true},
+				{at: time.Second, seq: 50, ts: 90100, pause: testPaused(false), drop: true},
+				{at: time.Second, seq: 51, ts: 90100, key: true, wantSeq: 11, wantTS: 90100},
+			},
+		},
+	} {
+		sources := []*videoSource{{id: "a"}, {id: "b"}}
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &downTrack{track: track, source: sources[0], switching: true}
+
+		start := time.Now()
+		for i, p := range test.packets {
+			if p.switchTo != nil {
+				d.source, d.switching = sources[*p.switchTo], true
+			}
+			if p.pause != nil {
+				d.paused, d.switching = *p.pause, true
+			}
+
+			payload := testVP8InterFrame
+			if p.key {
+				payload = testVP8KeyFrame
+			}
+			pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: p.seq, Timestamp: p.ts}, Payload: payload}
+			seq, ts, ok := d.rewrite(sources[p.source], pkt, start.Add(p.at))
+			switch {
+			case p.drop && ok:
+				t.Fatalf("%s: packet %d should be dropped, was sent as %d/%d", test.name, i, seq, ts)
+			case !p.drop && !ok:
+				t.Fatalf("%s: packet %d was dropped", test.name, i)
+			case !p.drop && (seq != p.wantSeq || ts != p.wantTS):
+				t.Fatalf("%s: packet %d: expected %d/%d, got %d/%d", test.name, i, p.wantSeq, p.wantTS, seq, ts)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// isKeyFrame reports if payload is the first packet of a keyframe. A subscriber can only start
+// decoding a source there. Codecs we can't parse always pass.
+func isKeyFrame(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		vp8 := &codecs.VP8Packet{}
+		if _, err := vp8.Unmarshal(payload); err != nil || len(vp8.Payload) == 0 {
+			return false
+		}
+		// The P bit of the VP8 frame header is 0 for keyframes
+		return vp8.S == 1 && vp8.PID == 0 && vp8.Payload[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		vp9 := &codecs.VP9Packet{}
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+		return !vp9.P && vp9.B && vp9.SID == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		// N of the aggregation header starts a new coded video sequence
+		return len(payload) > 0 && payload[0]&0x08 != 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264KeyFrame(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH265):
+		return isH265KeyFrame(payload)
+	}
+	return true
+}
+
+// isH264KeyFrame looks for an SPS or the start of an IDR slice
+func isH264KeyFrame(payload []byte) bool {
+	const (
+		naluIDR  = 5
+		naluSPS  = 7
+		naluSTAP = 24
+		naluFU   = 28
+	)
+	if len(payload) == 0 {
+		return false
+	}
+
+	switch naluType := payload[0] & 0x1F; naluType {
+	case naluIDR, naluSPS:
+		return true
+	case naluSTAP:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1F; t == naluIDR || t == naluSPS {
+				return true
+			}
+			i += 2 + size
+		}
+	case naluFU:
+		// Only the fragment with the start bit begins the slice
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == naluIDR
+	}
+	return false
+}
+
+// isH265KeyFrame looks for a VPS or the start of an IRAP picture
+func isH265KeyFrame(payload []byte) bool {
+	const (
+		naluIRAPFirst = 16
+		naluIRAPLast  = 21
+		naluVPS       = 32
+		naluAP        = 48
+		naluFU        = 49
+	)
+	isKey := func(t byte) bool {
+		return (t >= naluIRAPFirst && t <= naluIRAPLast) || t == naluVPS
+	}
+	if len(payload) < 2 {
+		return false
+	}
+
+	switch naluType := payload[0] >> 1 & 0x3F; naluType {
+	case naluAP:
+		for i := 2; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if isKey(payload[i+2] >> 1 & 0x3F) {
+				return true
+			}
+			i += 2 + size
+		}
+		return false
+	case naluFU:
+		return len(payload) > 2 && payload[2]&0x80 != 0 && isKey(payload[2]&0x3F)
+	default:
+		return isKey(naluType)
+	}
+}
@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestIsKeyFrame(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		key      bool
+	}{
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01, 0x00, 0x00}, false},
+		{"vp8 continuation", webrtc.MimeTypeVP8, []byte{0x00, 0x00, 0x9d, 0x01, 0x2a}, false},
+		{"vp8 second partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00, 0x00}, false},
+		{"vp8 descriptor only", webrtc.MimeTypeVP8, []byte{0x10}, false},
+		{"vp8 lowercase mime type", "video/vp8", []byte{0x10, 0x00, 0x9d}, true},
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x08, 0x00}, true},
+		{"vp9 interframe", webrtc.MimeTypeVP9, []byte{0x48, 0x00}, false},
+		{"vp9 middle of frame", webrtc.MimeTypeVP9, []byte{0x00, 0x00}, false},
+		{"av1 new sequence", webrtc.MimeTypeAV1, []byte{0x18, 0x00}, true},
+		{"av1 interframe", webrtc.MimeTypeAV1, []byte{0x10, 0x00}, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65, 0x88}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67, 0x42}, true},
+		{"h264 non-idr slice", webrtc.MimeTypeH264, []byte{0x41, 0x9a}, false},
+		{"h264 stap-a with sps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x09, 0x10, 0x00, 0x02, 0x67, 0x42}, true},
+		{"h264 stap-a without sps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x09, 0x10, 0x00, 0x02, 0x41, 0x9a}, false},
+		{"h264 fu-a idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x85, 0x88}, true},
+		{"h264 fu-a idr middle", webrtc.MimeTypeH264, []byte{0x7c, 0x05, 0x88}, false},
+		{"h264 fu-a non-idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x81, 0x9a}, false},
+		{"h264 empty", webrtc.MimeTypeH264, nil, false},
+		{"h265 idr", webrtc.MimeTypeH265, []byte{0x26, 0x01, 0xaf}, true},
+		{"h265 vps", webrtc.MimeTypeH265, []byte{0x40, 0x01, 0x0c}, true},
+		{"h265 trail", webrtc.MimeTypeH265, []byte{0x02, 0x01, 0xd0}, false},
+		{"h265 ap with vps", webrtc.MimeTypeH265, []byte{0x60, 0x01, 0x00, 0x02, 0x40, 0x01}, true},
+		{"h265 fu idr start", webrtc.MimeTypeH265, []byte{0x62, 0x01, 0x93, 0xaf}, true},
+		{"h265 fu idr middle", webrtc.MimeTypeH265, []byte{0x62, 0x01, 0x13, 0xaf}, false},
+		{"unknown codec passes", webrtc.MimeTypeOpus, []byte{0xfc}, true},
+	} {
+		if got := isKeyFrame(test.mimeType, test.payload); got != test.key {
+			t.Errorf("%s: expected keyframe %v, got %v", test.name, test.key, got)
+		}
+	}
+}
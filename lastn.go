@@ -0,0 +1,362 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// Audio level is -dBov, 0 is the loudest and 127 silence
+	speakerLevelThreshold = 50
+	// Number of consecutive loud packets before someone counts as speaking (~100ms of Opus)
+	speakerMinPackets = 5
+)
+
+// speakerDetector tracks when each publisher last spoke, using the audio level header extension
+type speakerDetector struct {
+	mu         sync.Mutex
+	loudCount  map[string]int
+	lastActive map[string]time.Time
+	order      []string
+}
+
+func newSpeakerDetector() *speakerDetector {
+	return &speakerDetector{
+		loudCount:  map[string]int{},
+		lastActive: map[string]time.Time{},
+	}
+}
+
+// observe records the audio level of one packet sent by the publisher of streamID
+func (s *speakerDetector) observe(streamID string, ext rtp.AudioLevelExtension) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ext.Level > speakerLevelThreshold {
+		s.loudCount[streamID] = 0
+		return
+	}
+
+	s.loudCount[streamID]++
+	if s.loudCount[streamID] >= speakerMinPackets {
+		s.lastActive[streamID] = time.Now()
+	}
+}
+
+func (s *speakerDetector) remove(streamID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loudCount, streamID)
+	delete(s.lastActive, streamID)
+}
+
+// ranking returns when every known publisher last spoke
+func (s *speakerDetector) ranking() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ranking := make(map[string]time.Time, len(s.lastActive))
+	for streamID, t := range s.lastActive {
+		ranking[streamID] = t
+	}
+	return ranking
+}
+
+// changed reports if the N most recent speakers differ from the last call
+func (s *speakerDetector) changed(n int) bool {
+	ranking := s.ranking()
+	order := make([]string, 0, len(ranking))
+	for streamID := range ranking {
+		order = append(order, streamID)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return ranking[order[i]].After(ranking[order[j]])
+	})
+	if n > 0 && len(order) > n {
+		order = order[:n]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fmt.Sprint(order) == fmt.Sprint(s.order) {
+		return false
+	}
+	s.order = order
+	return true
+}
+
+// selectVideoSources returns the video sources a peer should receive, most important first.
+// Pinned publishers come first, then the N most recently active speakers. Must hold listLock.
+func selectVideoSources(p *peerConnectionState) []*videoSource {
+	// Until the peer answered we don't know which codecs it can decode
+	negotiated, known := negotiatedCodecs(p.peerConnection, webrtc.RTPCodecTypeVideo)
+	if !known {
+		p.awaitingAnswer = true
+		return nil
+	}
+
+	inRoom := []*videoSource{}
+	compatibleStreams := map[string]bool{}
+	for _, s := range videoSources {
+		// Don't receive videos we are sending, make sure we don't have loopback
+		if s.publisher == p.peerConnection || s.room != p.room {
+			continue
+		}
+		inRoom = append(inRoom, s)
+		if codecSupported(negotiated, s.codec) {
+			compatibleStreams[s.streamID] = true
+		}
+	}
+
+	// Skip sources the peer can't decode, a compatible track of the same publisher takes their place
+	candidates := []*videoSource{}
+	for _, s := range inRoom {
+		if p.canReceive(negotiated, s.id, s.streamID, webrtc.RTPCodecTypeVideo, s.codec, compatibleStreams[s.streamID]) {
+			candidates = append(candidates, s)
+		}
+	}
+
+	return rankVideoSources(candidates, p.pinned, speakers.ranking(), *lastN)
+}
+
+// rankVideoSources orders candidates by pin order, then by how recently their publisher
+// spoke, and keeps the pinned ones plus the first n others. n of 0 keeps all.
+func rankVideoSources(candidates []*videoSource, pinnedStreams []string, ranking map[string]time.Time, n int) []*videoSource {
+	pinned := map[string]int{}
+	for i, streamID := range pinnedStreams {
+		pinned[streamID] = i
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		pa, aPinned := pinned[a.streamID]
+		pb, bPinned := pinned[b.streamID]
+		switch {
+		case aPinned && bPinned:
+			return pa < pb
+		case aPinned != bPinned:
+			return aPinned
+		}
+
+		if ta, tb := ranking[a.streamID], ranking[b.streamID]; !ta.Equal(tb) {
+			return ta.After(tb)
+		}
+		if !a.created.Equal(b.created) {
+			return a.created.Before(b.created)
+		}
+		return a.id < b.id
+	})
+
+	// Pinned sources come on top of the N speakers, they don't take their slots
+	pinnedCount := 0
+	for pinnedCount < len(candidates) {
+		if _, ok := pinned[candidates[pinnedCount].streamID]; !ok {
+			break
+		}
+		pinnedCount++
+	}
+	if n > 0 && len(candidates) > pinnedCount+n {
+		candidates = candidates[:pinnedCount+n]
+	}
+	return candidates
+}
+
+// assignDownTracks points the down-tracks of a peer at the sources it should receive.
+// Sources are swapped in place where possible. If down-tracks need to be added or
+// removed and renegotiate is false nothing is done and needsRenegotiation is returned.
+// Must hold listLock.
+func assignDownTracks(p *peerConnectionState, renegotiate bool) (needsRenegotiation bool, err error) {
+	want := selectVideoSources(p)
+	wanted := map[*videoSource]bool{}
+	for _, s := range want {
+		wanted[s] = true
+	}
+
+	// Keep every down-track that already shows a wanted source
+	assigned := map[*videoSource]bool{}
+	free := []*downTrack{}
+	for _, d := range p.downTracks {
+		if s := d.currentSource(); s != nil && wanted[s] {
+			assigned[s] = true
+			continue
+		}
+		free = append(free, d)
+	}
+
+	for _, s := range want {
+		if assigned[s] {
+			continue
+		}
+
+		if i := compatibleDownTrack(free, s); i >= 0 {
+			free[i].setSource(s)
+			free = append(free[:i], free[i+1:]...)
+			continue
+		}
+
+		if !renegotiate {
+			needsRenegotiation = true
+			continue
+		}
+
+		// All remaining slots use another codec, replace one of them
+		if *lastN > 0 && len(p.downTracks) >= len(want) && len(free) != 0 {
+			if err = p.removeDownTrack(free[0]); err != nil {
+				return
+			}
+			free = free[1:]
+		}
+
+		if _, err = p.addDownTrack(s); err != nil {
+			return
+		}
+	}
+
+	// Pause what is left over. Without a Last-N limit there is no reason to keep them around
+	for _, d := range free {
+		d.setSource(nil)
+		if *lastN > 0 {
+			continue
+		}
+
+		if !renegotiate {
+			needsRenegotiation = true
+			continue
+		}
+		if err = p.removeDownTrack(d); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func compatibleDownTrack(free []*downTrack, s *videoSource) int {
+	for i, d := range free {
+		if d.compatible(s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// addDownTrack creates a new video down-track for the peer showing s. Must hold listLock.
+func (p *peerConnectionState) addDownTrack(s *videoSource) (*downTrack, error) {
+	p.downTrackCount++
+	id := fmt.Sprintf("video-%s-%d", p.id, p.downTrackCount)
+
+	track, err := webrtc.NewTrackLocalStaticRTP(s.codec, id, id)
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := p.peerConnection.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newDownTrack(track, sender)
+	d.setSource(s)
+	p.downTracks = append(p.downTracks, d)
+	return d, nil
+}
+
+// removeDownTrack stops and removes a video down-track from the peer. Must hold listLock.
+func (p *peerConnectionState) removeDownTrack(d *downTrack) error {
+	d.setSource(nil)
+	for i := range p.downTracks {
+		if p.downTracks[i] == d {
+			p.downTracks = append(p.downTracks[:i], p.downTracks[i+1:]...)
+			break
+		}
+	}
+	return p.peerConnection.RemoveTrack(d.sender)
+}
+
+// hasDownTrack reports if trackID belongs to one of the peer's video down-tracks
+func (p *peerConnectionState) hasDownTrack(trackID string) bool {
+	for _, d := range p.downTracks {
+		if d.track.ID() == trackID {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseDownTracks detaches the down-tracks of a closed peer from their sources
+func (p *peerConnectionState) releaseDownTracks() {
+	for _, d := range p.downTracks {
+		d.setSource(nil)
+	}
+	p.downTracks = nil
+}
+
+// refreshDownTracks reassigns down-tracks after speaker or pin changes, renegotiating only if needed
+func refreshDownTracks() {
+	listLock.Lock()
+	renegotiate := false
+	for i := range peerConnections {
+		needsRenegotiation, err := assignDownTracks(peerConnections[i], false)
+		if err != nil {
+			mainLogger.Errorf("Failed to assign down-tracks: %v", err)
+		}
+		renegotiate = renegotiate || needsRenegotiation
+	}
+	listLock.Unlock()
+
+	if renegotiate {
+		signalPeerConnections()
+	}
+}
+
+// setPinned pins or unpins the publisher with streamID for the peer behind pc. Only streams
+// published in the room can be pinned, a stream that left can still be unpinned.
+func setPinned(pc *webrtc.PeerConnection, streamID string, pin bool) error {
+	listLock.Lock()
+	for _, p := range peerConnections {
+		if p.peerConnection != pc {
+			continue
+		}
+
+		known := !pin && slices.Contains(p.pinned, streamID)
+		for trackID, t := range trackLocals {
+			if trackRooms[trackID] == p.room && t.StreamID() == streamID {
+				known = true
+				break
+			}
+		}
+		if !known {
+			listLock.Unlock()
+			return fmt.Errorf("%w: %s", errUnknownStream, streamID)
+		}
+
+		pinned := []string{}
+		for _, id := range p.pinned {
+			if id != streamID {
+				pinned = append(pinned, id)
+			}
+		}
+		if pin {
+			pinned = append(pinned, streamID)
+		}
+		p.pinned = pinned
+	}
+	listLock.Unlock()
+
+	refreshDownTracks()
+	return nil
+}
@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRankVideoSources(t *testing.T) {
+	start := time.Now()
+	// Publishers a to e joined in order, c spoke last, then a, then e
+	ranking := map[string]time.Time{
+		"c": start.Add(3 * time.Second),
+		"a": start.Add(2 * time.Second),
+		"e": start.Add(time.Second),
+	}
+
+	for _, test := range []struct {
+		name   string
+		pinned []string
+		n      int
+		want   string
+	}{
+		{name: "all by speaker, then by join order", want: "c,a,e,b,d"},
+		{name: "last n speakers", n: 2, want: "c,a"},
+		{name: "n larger than the room", n: 10, want: "c,a,e,b,d"},
+		{name: "pinned come first in pin order", pinned: []string{"d", "b"}, want: "d,b,c,a,e"},
+		{name: "pinned come on top of n", pinned: []string{"d"}, n: 2, want: "d,c,a"},
+		{name: "pinned speaker doesn't take a slot", pinned: []string{"a"}, n: 1, want: "a,c"},
+		{name: "pinned stream that isn't a candidate", pinned: []string{"x"}, n: 1, want: "c"},
+	} {
+		// Shuffled, so the order only comes from the ranking
+		candidates := []*videoSource{}
+		for _, streamID := range []string{"b", "e", "a", "d", "c"} {
+			joined := start.Add(-time.Minute + time.Duration(strings.Index("abcde", streamID))*time.Second)
+			candidates = append(candidates, &videoSource{id: "video-" + streamID, streamID: streamID, created: joined})
+		}
+
+		got := []string{}
+		for _, s := range rankVideoSources(candidates, test.pinned, ranking, test.n) {
+			got = append(got, s.streamID)
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Errorf("%s: expected %s, got %s", test.name, test.want, strings.Join(got, ","))
+		}
+	}
+}
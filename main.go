@@ -13,38 +13,56 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
 	"text/template"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pion/interceptor"
 	"github.com/pion/interceptor/pkg/cc"
-	"github.com/pion/interceptor/pkg/gcc"
 	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/logging"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
 )
 
 // nolint
 var (
-	addr     = flag.String("addr", ":8080", "http service address")
-	upgrader = websocket.Upgrader{
+	addr              = flag.String("addr", ":8080", "http service address")
+	configPath        = flag.String("config", "", "path to a JSON config file, see config.example.json")
+	lastN             = flag.Int("last-n", 0, "forward video of only the N most recently active speakers to each peer, 0 forwards all")
+	adminToken        = flag.String("admin-token", "", "bearer token the /admin endpoints require, without one they only answer loopback requests")
+	publisherFeedback = flag.String("publisher-feedback", "remb", "how publishers are told the bitrate their subscribers can take: remb, tmmbr or off")
+	upgrader          = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
 	indexTemplate = &template.Template{}
 
-	// lock for peerConnections and trackLocals
+	config = &serverConfig{}
+
+	// lock for peerConnections, trackLocals, trackRooms, trackMutes and videoSources
 	listLock        sync.RWMutex
-	peerConnections []peerConnectionState
+	peerConnections []*peerConnectionState
 	trackLocals     map[string]*webrtc.TrackLocalStaticRTP
+	trackRooms      map[string]string
+	trackMutes      map[string]*trackMute
+	videoSources    map[string]*videoSource
+
+	speakers = newSpeakerDetector()
+
+	// per-packet log of inbound RTP, nil unless configured
+	arrivals *arrivalLog
 
 	mainLogger    = logging.NewDefaultLoggerFactory().NewLogger("sfu-ws")
 	bitrateLogger = logging.NewDefaultLoggerFactory().NewLogger("bitrate")
-	pacer         *gcc.LeakyBucketPacer
 )
 
 // Logger struct holds the log file and logger instance
@@ -99,104 +117,70 @@ type websocketMessage struct {
 }
 
 type peerConnectionState struct {
+	id             string
+	room           string
 	peerConnection *webrtc.PeerConnection
 	websocket      *threadSafeWriter
 	clientType     string
+	pacer          *pacer
+	estimator      cc.BandwidthEstimator
+	bwe            *bweRecorder
+	statsGetter    stats.Getter
+	uplink         *uplinkEstimator
+	// bitrate of every inbound stream
+	trackers *bitrateTrackers
+	// what the client reports on its metrics data channel
+	client *clientReports
+	// rate limits and channels of the data channel relay
+	relay *peerRelay
+
+	// last decision of the bandwidth allocator, only changes are reported
+	lastAllocation *bandwidthAllocation
+	// bitrate the publisher is capped at by an admin, 0 follows the subscribers
+	publisherCap int
+	// bitrate the subscribers of the publisher's video can take, 0 if unknown
+	subscriberCap int
+
+	// video is sent through per peer down-tracks, so sources can be switched for Last-N
+	pinned         []string
+	downTracks     []*downTrack
+	downTrackCount int
+
+	// tracks skipped because the peer can't decode their codec
+	unavailable    map[string]bool
+	awaitingAnswer bool
+	// the websocket is gone, the session is kept for the grace period without signaling
+	signalingLost bool
 }
 
-// BitrateTracker helps calculate bitrate for a specific track
-type BitrateTracker struct {
-	mu               sync.Mutex
-	lastPacketTime   time.Time
-	lastPacketBytes  uint64
-	currentBitrate   float64
-	intervalDuration time.Duration
-	currentDelay     time.Duration
-}
-
-// AddPacket adds a new packet to the bitrate calculation
-func (bt *BitrateTracker) AddPacket(packetSize int, packetDelayImpl *PacketDelayCalculatorImpl) {
-	bt.mu.Lock()
-	defer bt.mu.Unlock()
-
-	now := time.Now()
-	bt.lastPacketBytes += uint64(packetSize)
+func main() {
+	// Parse the flags passed to program
+	flag.Parse()
 
-	// If more than the interval has passed, calculate bitrate
-	if now.Sub(bt.lastPacketTime) >= bt.intervalDuration {
-		// Calculate bitrate in bits per second
-		bt.currentBitrate = float64(bt.lastPacketBytes*8) / bt.intervalDuration.Seconds()
-		delay := packetDelayImpl.GetAverageDelay()
-		bt.currentDelay = delay
-		// Reset for next interval
-		bt.lastPacketTime = now
-		bt.lastPacketBytes = 0
+	var err error
+	if config, err = loadConfig(*configPath); err != nil {
+		panic(err)
 	}
-}
-
-// GetBitrate returns the current bitrate
-func (bt *BitrateTracker) GetBitrate() float64 {
-	bt.mu.Lock()
-	defer bt.mu.Unlock()
-	return bt.currentBitrate
-}
-
-func (bt *BitrateTracker) GetDelay() time.Duration {
-	bt.mu.Lock()
-	defer bt.mu.Unlock()
-	return bt.currentDelay
-}
 
-// NewBitrateTracker creates a new BitrateTracker
-func NewBitrateTracker() *BitrateTracker {
-	return &BitrateTracker{
-		intervalDuration: time.Second * 1, // Calculate bitrate every second
+	// Replay a TWCC trace offline instead of serving
+	if flag.Arg(0) == "replay" {
+		if err = runReplay(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-}
-
-// Packet Delay Calculator
-type PacketDelayCalculator interface {
-	CalculateDelay(packet *rtp.Packet) time.Duration
-}
-
-type PacketDelayCalculatorImpl struct {
-	totalDelay  time.Duration
-	packetCount int
-}
-
-// NewPacketDelayCalculator creates a new PacketDelayCalculator
-func NewPacketDelayCalculator() *PacketDelayCalculatorImpl {
-	return &PacketDelayCalculatorImpl{}
-}
 
-// CalculateDelay calculates the delay of a packet
-func (p *PacketDelayCalculatorImpl) CalculateDelay(packet *rtp.Packet) time.Duration {
-	// arrivalTime := time.Now().Unix()
-	// rtpTimestamp := packet.Timestamp / 90000
-	// mainLogger.Infof("Arrival Time: %v, RTP Timestamp: %v\n", arrivalTime, rtpTimestamp)
-	delay := time.Duration(0) //arrivalTime.Sub(time.Unix(int64(rtpTimestamp), 0))
-	p.totalDelay += delay
-	p.packetCount++
-	return delay
-}
-
-// GetAverageDelay returns the average delay over the last second
-func (p *PacketDelayCalculatorImpl) GetAverageDelay() time.Duration {
-	if p.packetCount == 0 {
-		return 0
+	if config.ArrivalLog.Path != "" {
+		if arrivals, err = newArrivalLog(config.ArrivalLog); err != nil {
+			panic(err)
+		}
 	}
-	averageDelay := p.totalDelay / time.Duration(p.packetCount)
-	p.totalDelay = 0
-	p.packetCount = 0
-	return averageDelay
-}
-
-func main() {
-	// Parse the flags passed to program
-	flag.Parse()
 
 	// Init other state
 	trackLocals = map[string]*webrtc.TrackLocalStaticRTP{}
+	trackRooms = map[string]string{}
+	trackMutes = map[string]*trackMute{}
+	videoSources = map[string]*videoSource{}
 
 	// Read index.html from disk into memory, serve whenever anyone requests /
 	indexHTML, err := os.ReadFile("index.html")
@@ -208,9 +192,25 @@ func main() {
 	// websocket handler
 	http.HandleFunc("/websocket", websocketHandler)
 
+	// admin override of the bitrate a publisher is asked to send
+	http.HandleFunc("/admin/publisher-cap", publisherCapHandler)
+
+	// internal state of the bandwidth estimators, per connection
+	http.HandleFunc("/api/bwe", bweStatsHandler)
+
+	// JSON stats of every peer and its tracks, /api/stats/{peer} adds the estimator details
+	http.HandleFunc("/api/stats", statsHandler)
+	http.HandleFunc("/api/stats/{peer}", peerStatsHandler)
+
+	// the per second stats samples as they are produced, for live dashboards
+	http.HandleFunc("/api/stats/stream", statsStreamHandler)
+
+	// Prometheus metrics of rooms, peers and streams
+	http.HandleFunc("/metrics", metricsHandler)
+
 	// index.html handler
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if err = indexTemplate.Execute(w, "ws://"+r.Host+"/websocket?client=server"); err != nil {
+		if err = indexTemplate.Execute(w, "ws://"+r.Host+"/websocket?client=server&room="+url.QueryEscape(r.URL.Query().Get("room"))); err != nil {
 			mainLogger.Errorf("Failed to parse index template: %v", err)
 		}
 	})
@@ -222,20 +222,46 @@ func main() {
 		}
 	}()
 
+	// follow the active speakers when only forwarding Last-N video
+	go func() {
+		for range time.NewTicker(time.Millisecond * 500).C {
+			if *lastN > 0 && speakers.changed(*lastN) {
+				refreshDownTracks()
+			}
+		}
+	}()
+
+	// split the estimated bandwidth of every peer across its down-tracks
+	go func() {
+		for range time.NewTicker(time.Second).C {
+			allocateBandwidth()
+		}
+	}()
+
 	// start HTTP server
 	if err = http.ListenAndServe(*addr, nil); err != nil { //nolint: gosec
 		mainLogger.Errorf("Failed to start http server: %v", err)
 	}
 }
 
-// Add to list of tracks and fire renegotation for all PeerConnections
-func addTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
+// Add to list of tracks and fire renegotation for all PeerConnections.
+// Audio is fanned out through a shared TrackLocal, video through per peer down-tracks.
+func addTrack(t *webrtc.TrackRemote, publisher *webrtc.PeerConnection, room string) (*webrtc.TrackLocalStaticRTP, *videoSource) {
 	listLock.Lock()
 	defer func() {
 		listLock.Unlock()
 		signalPeerConnections()
 	}()
 
+	trackRooms[t.ID()] = room
+	trackMutes[t.ID()] = &trackMute{publisher: publisher}
+
+	if t.Kind() == webrtc.RTPCodecTypeVideo {
+		source := newVideoSource(t, publisher, room)
+		videoSources[t.ID()] = source
+		return nil, source
+	}
+
 	// Create a new TrackLocal with the same codec as our incoming
 	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
 	if err != nil {
@@ -243,18 +269,28 @@ func addTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
 	}
 
 	trackLocals[t.ID()] = trackLocal
-	return trackLocal
+	return trackLocal, nil
 }
 
 // Remove from list of tracks and fire renegotation for all PeerConnections
-func removeTrack(t *webrtc.TrackLocalStaticRTP) {
+func removeTrack(t *webrtc.TrackRemote) {
 	listLock.Lock()
 	defer func() {
 		listLock.Unlock()
 		signalPeerConnections()
 	}()
 
+	if source, ok := videoSources[t.ID()]; ok {
+		source.detachAll()
+		delete(videoSources, t.ID())
+	}
 	delete(trackLocals, t.ID())
+	delete(trackRooms, t.ID())
+	delete(trackMutes, t.ID())
+
+	if t.Kind() == webrtc.RTPCodecTypeAudio {
+		speakers.remove(t.StreamID())
+	}
 }
 
 // signalPeerConnections updates each PeerConnection so that it is getting all the expected media tracks
@@ -268,10 +304,16 @@ func signalPeerConnections() {
 	attemptSync := func() (tryAgain bool) {
 		for i := range peerConnections {
 			if peerConnections[i].peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				peerConnections[i].releaseDownTracks()
 				peerConnections = append(peerConnections[:i], peerConnections[i+1:]...)
 				return true // We modified the slice, start from the beginning
 			}
 
+			// Nobody would answer the offer
+			if peerConnections[i].signalingLost {
+				continue
+			}
+
 			// map of sender we already are seanding, so we don't double send
 			existingSenders := map[string]bool{}
 
@@ -282,6 +324,11 @@ func signalPeerConnections() {
 
 				existingSenders[sender.Track().ID()] = true
 
+				// Video down-tracks are managed by assignDownTracks
+				if peerConnections[i].hasDownTrack(sender.Track().ID()) {
+					continue
+				}
+
 				// If we have a RTPSender that doesn't map to a existing track remove and signal
 				if _, ok := trackLocals[sender.Track().ID()]; !ok {
 					if err := peerConnections[i].peerConnection.RemoveTrack(sender); err != nil {
@@ -299,24 +346,28 @@ func signalPeerConnections() {
 				existingSenders[receiver.Track().ID()] = true
 			}
 
-			// Add all track we aren't sending yet to the PeerConnection
+			// Add all track we aren't sending yet to the PeerConnection, only from the same room
 			for trackID := range trackLocals {
+				if trackRooms[trackID] != peerConnections[i].room {
+					continue
+				}
+
 				if _, ok := existingSenders[trackID]; !ok {
+					trackLocal := trackLocals[trackID]
+					negotiated, known := negotiatedCodecs(peerConnections[i].peerConnection, trackLocal.Kind())
+					if !known {
+						peerConnections[i].awaitingAnswer = true
+						continue
+					}
+					if !peerConnections[i].canReceive(negotiated, trackID, trackLocal.StreamID(), trackLocal.Kind(), trackLocal.Codec(), false) {
+						continue
+					}
+
 					rtpSender, err := peerConnections[i].peerConnection.AddTrack(trackLocals[trackID])
 					if err != nil {
 						return true
 					}
 
-					/*if trackLocals[trackID].Kind() == webrtc.RTPCodecTypeVideo {
-						ssrc := uint32(trackLocals[trackID].SSRC())
-						err := pacer.AddStream(ssrc, rtpSender)
-						if err != nil {
-							mainLogger.Errorf("Failed to AddStream to pacer for SSRC=%d: %v", ssrc, err)
-						} else {
-							mainLogger.Infof("Pacer AddStream successful for SSRC=%d", ssrc)
-						}
-					}*/
-
 					go func(sender *webrtc.RTPSender) {
 						rtcpBuf := make([]byte, 1500)
 						for {
@@ -328,18 +379,26 @@ func signalPeerConnections() {
 				}
 			}
 
+			// Point the video down-tracks at the sources this peer should see
+			if _, err := assignDownTracks(peerConnections[i], true); err != nil {
+				return true
+			}
+
 			offer, err := peerConnections[i].peerConnection.CreateOffer(nil)
 			if err != nil {
+				signalingErrors.inc(peerConnections[i].room, "create-offer")
 				return true
 			}
 
 			if err = peerConnections[i].peerConnection.SetLocalDescription(offer); err != nil {
+				signalingErrors.inc(peerConnections[i].room, "set-local-description")
 				return true
 			}
 
 			offerString, err := json.Marshal(offer)
 			if err != nil {
 				mainLogger.Errorf("Failed to marshal offer to json: %v", err)
+				signalingErrors.inc(peerConnections[i].room, "marshal-offer")
 				return true
 			}
 
@@ -349,6 +408,7 @@ func signalPeerConnections() {
 				Event: "offer",
 				Data:  string(offerString),
 			}); err != nil {
+				signalingErrors.inc(peerConnections[i].room, "send-offer")
 				return true
 			}
 		}
@@ -392,42 +452,95 @@ func dispatchKeyFrame() {
 	}
 }
 
-func getInboundRTPStreamStats(peerConnection *webrtc.PeerConnection) {
-	stats := peerConnection.GetStats()
-	for k, stat := range stats {
-		mainLogger.Infof("Stats %v:: %v\n", k, stats)
-		if inboundStat, ok := stat.(webrtc.InboundRTPStreamStats); ok {
-			mainLogger.Infof("Bytes Received: %d, Packets Lost: %d\n",
-				inboundStat.BytesReceived, inboundStat.PacketsLost)
-		}
-	}
-}
-
 // Handle incoming websockets
 func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 	clientType := r.URL.Query().Get("client")
+	room := r.URL.Query().Get("room")
+	// The room is part of the stats file names
+	if err := validateRoom(room); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Upgrade HTTP request to Websocket
-	unsafeConn, err := upgrader.Upgrade(w, r, nil)
+	// The bandwidth estimator can be picked per connection for experiments
+	bwe := r.URL.Query().Get("bwe")
+	if bwe == "" {
+		bwe = config.BWE.Default
+	}
+	if _, ok := bandwidthEstimators[bwe]; !ok {
+		http.Error(w, fmt.Sprintf("unknown bwe %q, choose one of %v", bwe, bandwidthEstimatorNames()), http.StatusBadRequest)
+		return
+	}
+	twccTrace := config.BWE.TWCCTrace
+	if r.URL.Query().Has("twcc-trace") {
+		var err error
+		if twccTrace, err = strconv.ParseBool(r.URL.Query().Get("twcc-trace")); err != nil {
+			http.Error(w, "twcc-trace must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	shadows := config.BWE.Shadows
+	if r.URL.Query().Has("shadow") {
+		var err error
+		if shadows, err = parseShadows(r.URL.Query().Get("shadow")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if (bwe == "trace" || slices.Contains(shadows, "trace")) && config.BWE.Trace == "" {
+		http.Error(w, "the trace estimator needs bwe.trace to be configured", http.StatusBadRequest)
+		return
+	}
+
+	// Stats of the session go to <stats.dir>/<date>/<experiment>/
+	experiment := config.Stats.Experiment
+	if r.URL.Query().Has("experiment") {
+		experiment = r.URL.Query().Get("experiment")
+		if err := validateExperiment(experiment); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	peerID := uuid.NewString()
+	statsDir, err := config.Stats.sessionDir(experiment, time.Now())
 	if err != nil {
-		mainLogger.Errorf("Failed to upgrade HTTP to Websocket: ", err)
+		mainLogger.Errorf("Failed to create stats directory: %v", err)
+		http.Error(w, "failed to create the stats directory", http.StatusInternalServerError)
 		return
 	}
 
-	statsLogger, err := NewLogger("app.csv")
+	// Upgrade HTTP request to Websocket
+	unsafeConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Fatalf("Could not create statsLogger: %v", err)
+		mainLogger.Errorf("Failed to upgrade HTTP to Websocket: ", err)
+		signalingErrors.inc(room, "upgrade")
+		return
 	}
-	defer statsLogger.Close()
-	statsLogger.Infof("SSRC,Timestamp,Kind,PacketsReceived,PacketsLost,LossRation,Jitter,CurrentBitrate,TargetBitrate")
 
 	c := &threadSafeWriter{unsafeConn, sync.Mutex{}}
 
 	// When this frame returns close the Websocket
 	defer c.Close() //nolint
 
-	bitrateTrackers := map[string]*BitrateTracker{}
+	// Stats files are only created for sessions that got a websocket
+	statsExport, err := newStatsExporter(statsDir, room, peerID, "", statsHeader(shadows))
+	if err != nil {
+		mainLogger.Errorf("Failed to create stats file: %v", err)
+		closeWebsocket(c, websocket.CloseInternalServerErr, "failed to create the stats file")
+		return
+	}
+	defer statsExport.Close() //nolint: errcheck
+	outboundExport, err := newStatsExporter(statsDir, room, peerID, "-outbound", outboundColumns)
+	if err != nil {
+		mainLogger.Errorf("Failed to create stats file: %v", err)
+		closeWebsocket(c, websocket.CloseInternalServerErr, "failed to create the stats file")
+		return
+	}
+	defer outboundExport.Close() //nolint: errcheck
 
 	interceptorRegistry := &interceptor.Registry{}
 
@@ -439,78 +552,87 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	})
 	interceptorRegistry.Add(statsInterceptorFactory)
 
+	// The trace goes in before the congestion controller, so it sees packets leave the pacer
+	traceFactory := &twccTraceFactory{}
+	if twccTrace {
+		traceFactory.path = filepath.Join(statsDir, fmt.Sprintf("twcc-%s.trace", peerID))
+	}
+	interceptorRegistry.Add(traceFactory)
+
+	// Per SSRC loss from TWCC feedback for the outbound stats, it needs the sequence numbers too
+	outboundTWCCFactory := &outboundTWCCFactory{}
+	outboundTWCCChan := make(chan *outboundTWCC, 1)
+	outboundTWCCFactory.OnNewPeerConnection(func(_ string, o *outboundTWCC) {
+		outboundTWCCChan <- o
+	})
+	interceptorRegistry.Add(outboundTWCCFactory)
+
 	if err != nil {
 		panic(err)
 	}
 
 	m := &webrtc.MediaEngine{}
 
-	// --- Explicitly Register  Codecs to Prioritize H264 ---
-	// Register Opus Audio
-	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1", RTCPFeedback: nil},
-		PayloadType:        111, // Standard PT for Opus
-	}, webrtc.RTPCodecTypeAudio); err != nil {
+	// Register the configured codec catalogue, in the preference order of the room
+	if err := registerCodecs(m, room); err != nil {
 		panic(err)
 	}
 
-	// Register H264 Video (PRIORITY 1)
-	// Make sure to include packetization-mode=1 for compatibility
-	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypeH264,
-			ClockRate:    90000,
-			Channels:     0,
-			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", // Baseline profile, packetization-mode=1
-			RTCPFeedback: []webrtc.RTCPFeedback{{Type: "goog-remb", Parameter: ""}, {Type: "ccm", Parameter: "fir"}, {Type: "nack", Parameter: ""}, {Type: "nack", Parameter: "pli"}, {Type: "transport-cc"}},
-		},
-		PayloadType: 102, // Example Payload Type for H264 (ensure it doesn't clash)
-	}, webrtc.RTPCodecTypeVideo); err != nil {
+	// Audio levels tell us who is speaking for Last-N forwarding
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
 		panic(err)
 	}
 
-	// Register VP8 Video (PRIORITY 2)
-	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypeVP8,
-			ClockRate:    90000,
-			Channels:     0,
-			SDPFmtpLine:  "", // VP8 typically doesn't need fmtp lines like H264
-			RTCPFeedback: []webrtc.RTCPFeedback{{Type: "goog-remb", Parameter: ""}, {Type: "ccm", Parameter: "fir"}, {Type: "nack", Parameter: ""}, {Type: "nack", Parameter: "pli"}, {Type: "transport-cc"}},
-		},
-		PayloadType: 96, // Example Payload Type for VP8
-	}, webrtc.RTPCodecTypeVideo); err != nil {
+	// abs-send-time lets us estimate the uplink of publishers on our side
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.ABSSendTimeURI}, webrtc.RTPCodecTypeVideo); err != nil {
 		panic(err)
 	}
-	// --- End Explicit Codec Registration ---
 
-	// Create a new PacketDelayCalculator
+	// abs-capture-time gives the one-way delay from capture when the clocks are in sync
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: absCaptureTimeURI}, kind); err != nil {
+			panic(err)
+		}
+	}
+
+	trackers := newBitrateTrackers()
+	client := &clientReports{}
+
+	// Create a new PacketDelayCalculator, it keeps the delay of every inbound SSRC
 	packetDelayCalculator := NewPacketDelayCalculator()
 
 	// Create a Congestion Controller. This analyzes inbound and outbound data and provides
 	// suggestions on how much we should be sending.
 	//
-	// Passing `nil` means we use the default Estimation Algorithm which is Google Congestion Control.
-	// You can use the other ones that Pion provides, or write your own!
-	pacer = gcc.NewLeakyBucketPacer(2_000_000)
+	// The estimator is looked up by name in bandwidthEstimators, Google Congestion Control
+	// unless configured otherwise. Register your own there!
+	//
+	// Every PeerConnection gets its own pacer, the estimator keeps it at the target bitrate
+	// and closes it together with the PeerConnection. Shadow estimators see the same
+	// packets and feedback for comparison, but leave the pacer alone.
+	sendPacer := newPacer(config.BWE.InitialBitrate)
 	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
-		return gcc.NewSendSideBWE(
-			gcc.SendSideBWEInitialBitrate(2_000_000),
-			//gcc.SendSideBWEPacer(pacer),
-		)
+		return newShadowedEstimator(bwe, shadows, sendPacer)
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	go pacer.Run()
-
 	estimatorChan := make(chan cc.BandwidthEstimator, 1)
 	congestionController.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) { //nolint: revive
 		estimatorChan <- estimator
 	})
 
 	interceptorRegistry.Add(congestionController)
+	interceptorRegistry.Add(sendPacer)
+
+	// Estimate what the publisher can send us, GCC above only covers what we send
+	uplinkFactory := &uplinkEstimatorFactory{}
+	uplinkChan := make(chan *uplinkEstimator, 1)
+	uplinkFactory.OnNewPeerConnection(func(_ string, e *uplinkEstimator) {
+		uplinkChan <- e
+	})
+	interceptorRegistry.Add(uplinkFactory)
 	if err = webrtc.ConfigureTWCCHeaderExtensionSender(m, interceptorRegistry); err != nil {
 		panic(err)
 	}
@@ -537,51 +659,22 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-		mainLogger.Infof("✅ SERVER: New DataChannel '%s'-%d created by remote peer\n", d.Label(), d.ID())
-
-		// Handle when the data channel is opened
-		d.OnOpen(func() {
-			mainLogger.Infof("✅ SERVER: DataChannel '%s'-%d is open\n", d.Label(), d.ID())
-		})
-
-		// Handle incoming messages on the data channel
-		d.OnMessage(func(msg webrtc.DataChannelMessage) {
-			receivedMsg := string(msg.Data)
-			mainLogger.Infof("✅ SERVER: Received message on DataChannel '%s': %s\n", d.Label(), receivedMsg) // Log received message
-
-			// Check if the message is "hello world" and send reply
-			if receivedMsg == "hello world" {
-				replyMsg := "hello world accepted"
-				mainLogger.Infof("✅ SERVER: Sending reply: '%s'\n", replyMsg) // Log sending reply
-				if err := d.SendText(replyMsg); err != nil {
-					mainLogger.Errorf("❌ SERVER: Failed to send message on DataChannel '%s': %v", d.Label(), err)
-				}
-			} else {
-				mainLogger.Infof("✅ SERVER: Received unexpected message: '%s'\n", receivedMsg)
-			}
-		})
-
-		// Handle when the data channel is closed
-		d.OnClose(func() {
-			mainLogger.Infof("❌ SERVER: DataChannel '%s'-%d is closed\n", d.Label(), d.ID())
-		})
-
-		// Handle errors on the data channel
-		d.OnError(func(err error) {
-			mainLogger.Errorf("❌ SERVER: DataChannel '%s'-%d Error: %v\n", d.Label(), d.ID(), err)
-		})
-	})
-	// --- End Data Channel Handler ---
-
 	// Wait until our Bandwidth Estimator has been created
 	estimator := <-estimatorChan
+	uplink := <-uplinkChan
+	outbound := newOutboundStats(experiment, statsGetter, <-outboundTWCCChan)
 	bitrateTicker := time.NewTicker(1000 * time.Millisecond)
 	defer bitrateTicker.Stop() // Ensure the ticker is stopped when done
 
 	// When this frame returns close the PeerConnection
 	defer peerConnection.Close() //nolint
 
+	bweStats, err := newBWERecorder(statsDir, experiment, room, peerID, bwe, estimator)
+	if err != nil {
+		panic(err)
+	}
+	defer bweStats.Close()
+
 	// Accept one audio and one video track incoming
 	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
 		if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
@@ -593,15 +686,72 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add our new PeerConnection to global list
+	state := &peerConnectionState{
+		id:             peerID,
+		room:           room,
+		unavailable:    map[string]bool{},
+		peerConnection: peerConnection,
+		websocket:      c,
+		clientType:     clientType,
+		pacer:          sendPacer,
+		estimator:      estimator,
+		bwe:            bweStats,
+		statsGetter:    statsGetter,
+		trackers:       trackers,
+		uplink:         uplink,
+		client:         client,
+		relay:          newPeerRelay(),
+	}
+	// Once the state is listed it can be offered, the offer has to carry the control channel
+	openControlChannel(state)
 	listLock.Lock()
-	peerConnections = append(peerConnections, peerConnectionState{peerConnection, c, clientType})
+	peerConnections = append(peerConnections, state)
 	listLock.Unlock()
+	mainLogger.Infof("Peer %s joined room %q", peerID, room)
+
+	// Data channels only open after signaling, so the state is always there
+	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
+		handleDataChannel(state, d)
+	})
+
+	// Log the send side pacing and the estimator state of this PeerConnection
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				pacerStats := sendPacer.Stats()
+				bitrateLogger.Infof("Pacer: Queue: %v, Sent: %v, Dropped: %v, Target: %v%s", pacerStats.QueueDepth, pacerStats.Sent, pacerStats.Dropped, estimator.GetTargetBitrate()/1000, formatShadowTargets(estimator))
+
+				snapshot := bweStats.record(time.Now(), sendRTT(peerConnection, statsGetter))
+				bitrateLogger.Infof("BWE %s: RTT: %.2f, %s", bwe, snapshot.RTT, formatBWEStats(snapshot.Stats))
+
+				listLock.RLock()
+				samples := outbound.sample(time.Now(), state)
+				listLock.RUnlock()
+				for _, sample := range samples {
+					bitrateLogger.Infof("Outbound: Track: %s, Source: %s, SSRC: %d, Sent: %.0f, NACKs: %d, PLIs: %d, RR Loss: %.2f, RR Jitter: %.2f, RTT: %.2f, TWCC Loss: %d/%d, Target: %.0f", sample.Track, sample.Source, sample.SSRC, sample.SentKbps, sample.NACKsReceived, sample.PLIsReceived, sample.RRFractionLost, sample.RRJitterMs, sample.RTTMs, sample.TWCCPacketsLost, sample.TWCCPacketsReported, sample.TargetKbps)
+					outboundExport.write(sample)
+				}
+			}
+		}
+	}()
 
 	// Trickle ICE. Emit server candidate to client
 	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
 		if i == nil {
 			return
 		}
+		// The websocket is gone during the grace period
+		listLock.RLock()
+		signalingLost := state.signalingLost
+		listLock.RUnlock()
+		if signalingLost {
+			return
+		}
 		// If you are serializing a candidate make sure to use ToJSON
 		// Using Marshal will result in errors around `sdpMid`
 		candidateString, err := json.Marshal(i.ToJSON())
@@ -621,6 +771,8 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	})
 
 	// If PeerConnection is closed remove it from global list
+	closed := make(chan struct{})
+	markClosed := sync.OnceFunc(func() { close(closed) })
 	peerConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
 		mainLogger.Infof("Connection state change: %s", p)
 
@@ -630,6 +782,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 				mainLogger.Errorf("Failed to close PeerConnection: %v", err)
 			}
 		case webrtc.PeerConnectionStateClosed:
+			markClosed()
 			signalPeerConnections()
 		default:
 		}
@@ -648,13 +801,28 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		listLock.RUnlock()
 		codec := t.Codec()
 		mainLogger.Infof("Got remote track: Kind=%s, ID=%s, StreamID=%s, Codec=%s, PayloadType=%d, SSRC=%d", t.Kind(), t.ID(), t.StreamID(), codec.MimeType, codec.PayloadType, t.SSRC())
-		// Create a track to fan out our incoming video to all peers
-		trackLocal := addTrack(t)
+		// Create a track to fan out our incoming media to all peers
+		trackLocal, source := addTrack(t, peerConnection, room)
+		listLock.RLock()
+		mute := trackMutes[t.ID()]
+		listLock.RUnlock()
 
 		// a, b := peerConnection.GetStats().GetConnectionStats(peerConnection)
-		bitrateTrackers[trackLocal.Kind().String()] = NewBitrateTracker()
+		tracker := trackers.add(uint32(t.SSRC()), t.RID())
+		defer trackers.remove(uint32(t.SSRC()))
+		packetDelayCalculator.AddStream(uint32(t.SSRC()), codec.ClockRate, receiver.GetParameters().HeaderExtensions)
+		defer packetDelayCalculator.RemoveStream(uint32(t.SSRC()))
 
-		defer removeTrack(trackLocal)
+		defer removeTrack(t)
+
+		packetLog := arrivals.track(peerID, t, receiver)
+
+		audioLevelID := uint8(0)
+		for _, ext := range receiver.GetParameters().HeaderExtensions {
+			if ext.URI == sdp.AudioLevelURI {
+				audioLevelID = uint8(ext.ID)
+			}
+		}
 
 		// Read incoming RTCP packets
 		// Before these packets are returned they are processed by interceptors. For things
@@ -664,44 +832,84 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		rtpPkt := &rtp.Packet{}
 
 		go func() {
-			rtcpBuf := make([]byte, 1500)
 			for {
-				if _, _, err := receiver.Read(rtcpBuf); err != nil {
+				pkts, _, err := receiver.ReadRTCP()
+				if err != nil {
 					return
 				}
+				// Sender reports map RTP timestamps to the publisher's clock for the delay
+				for _, pkt := range pkts {
+					if sr, ok := pkt.(*rtcp.SenderReport); ok {
+						packetDelayCalculator.OnSenderReport(sr)
+					}
+				}
 			}
 		}()
 
 		go func(clientType string) {
-			var oldBytes int64 = 0
-			var oldPacketsReceived uint64 = 0
-			var oldPacketsLost int64 = 0
-			_ = oldBytes
-			for {
-				select {
-				case <-bitrateTicker.C: // Wait for the next tick
-					if t.Kind().String() == "video" {
-						if clientType != "client" {
-							continue
-						}
-						targetBitrate := estimator.GetTargetBitrate()
-						_ = targetBitrate
-
-						stats := statsGetter.Get(uint32(t.SSRC()))
-
-						tracker := bitrateTrackers[trackLocal.Kind().String()]
-						bitrate := tracker.GetBitrate()
-						_ = bitrate
-						bitrateLogger.Infof("t.SSRC: %v, t.Kind: %v, Received: %v, Lost: %v, Ratio: %.2f, Jitter: %.2f, Bitrate: %v, Target: %v, LastPacket: %v", uint32(t.SSRC()), t.Kind(), stats.InboundRTPStreamStats.PacketsReceived-oldPacketsReceived, stats.InboundRTPStreamStats.PacketsLost-oldPacketsLost, float64(stats.InboundRTPStreamStats.PacketsLost-oldPacketsLost)/float64(stats.InboundRTPStreamStats.PacketsReceived-oldPacketsReceived), stats.InboundRTPStreamStats.Jitter, (int64(stats.InboundRTPStreamStats.BytesReceived/1000)-oldBytes)*8, targetBitrate/1000, stats.InboundRTPStreamStats.LastPacketReceivedTimestamp)
-						statsLogger.Infof("%v,%v,%v,%v,%v,%.2f,%.2f,%v,%v", uint32(t.SSRC()), time.Now().Format("2006-01-02T15:04:05Z07:00"), t.Kind(), stats.InboundRTPStreamStats.PacketsReceived-oldPacketsReceived, stats.InboundRTPStreamStats.PacketsLost-oldPacketsLost, float64(stats.InboundRTPStreamStats.PacketsLost-oldPacketsLost)/float64(stats.InboundRTPStreamStats.PacketsReceived-oldPacketsReceived), stats.InboundRTPStreamStats.Jitter, (int64(stats.InboundRTPStreamStats.BytesReceived/1000)-oldBytes)*8, targetBitrate/1000)
-						//bitrateLogger.Infof("Old before: %v", oldBytes)
-						oldBytes = int64(stats.InboundRTPStreamStats.BytesReceived / 1000)
-						oldPacketsReceived = stats.InboundRTPStreamStats.PacketsReceived
-						oldPacketsLost = stats.InboundRTPStreamStats.PacketsLost
-
-						//bitrateLogger.Infof("Old now: %v", oldBytes)
+			var oldBytes uint64
+			var oldPacketsReceived uint64
+			var oldPacketsLost int64
+			for range bitrateTicker.C {
+				if t.Kind() != webrtc.RTPCodecTypeVideo || clientType != "client" {
+					continue
+				}
+				targetBitrate := estimator.GetTargetBitrate()
+				uplinkBitrate := uplink.GetEstimate()
+
+				stats := statsGetter.Get(uint32(t.SSRC()))
+				inbound := stats.InboundRTPStreamStats
+				received := inbound.PacketsReceived - oldPacketsReceived
+				lost := inbound.PacketsLost - oldPacketsLost
+				lossRatio := 0.0
+				if received != 0 {
+					lossRatio = float64(lost) / float64(received)
+				}
+				// Jitter is in RTP timestamp units
+				jitterMs := inbound.Jitter / float64(codec.ClockRate) * 1000
+				receivedKbps := float64((inbound.BytesReceived-oldBytes)*8) / 1000
+
+				bitrate := tracker.Stats()
+				delay := packetDelayCalculator.GetDelay(uint32(t.SSRC()))
+				bitrateLogger.Infof("t.SSRC: %v, t.Kind: %v, Received: %v, Lost: %v, Ratio: %.2f, Jitter: %.2f, Bitrate: %.0f, Target: %v, Uplink: %v, Delay: %v, SendDelay: %s, CaptureDelay: %s, EWMA: %.0f, P50: %.0f, P95: %.0f, LastPacket: %v", uint32(t.SSRC()), t.Kind(), received, lost, lossRatio, jitterMs, receivedKbps, targetBitrate/1000, uplinkBitrate/1000, bitrate.Delay, optionalMillis(delay.Send, delay.HasSend), optionalMillis(delay.Capture, delay.HasCapture), bitrate.EWMA/1000, bitrate.P50/1000, bitrate.P95/1000, stats.LastPacketReceivedTimestamp)
+
+				sample := &statsSample{
+					Timestamp:          time.Now(),
+					Experiment:         experiment,
+					Room:               room,
+					Peer:               peerID,
+					Track:              t.ID(),
+					RID:                t.RID(),
+					SSRC:               uint32(t.SSRC()),
+					Kind:               t.Kind().String(),
+					PacketsReceived:    received,
+					PacketsLost:        lost,
+					LossRatio:          lossRatio,
+					JitterMs:           jitterMs,
+					ReceivedKbps:       receivedKbps,
+					TargetKbps:         float64(targetBitrate) / 1000,
+					UplinkEstimateKbps: float64(uplinkBitrate) / 1000,
+					DelayMs:            bitrate.DelayMs,
+					SendDelayMs:        millis(delay.Send, delay.HasSend),
+					CaptureDelayMs:     millis(delay.Capture, delay.HasCapture),
+					WindowKbps:         bitrate.Bitrate / 1000,
+					EWMAKbps:           bitrate.EWMA / 1000,
+					P50Kbps:            bitrate.P50 / 1000,
+					P95Kbps:            bitrate.P95 / 1000,
+					shadows:            shadows,
+				}
+				if targets := shadowTargets(estimator); len(targets) != 0 {
+					sample.ShadowTargetsKbps = map[string]float64{}
+					for i, target := range targets {
+						sample.ShadowTargetsKbps[shadows[i]] = float64(target) / 1000
 					}
 				}
+				statsExport.write(sample)
+				liveStats.publish(sample)
+
+				oldBytes = inbound.BytesReceived
+				oldPacketsReceived = inbound.PacketsReceived
+				oldPacketsLost = inbound.PacketsLost
 			}
 		}(clientType)
 
@@ -710,19 +918,38 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				return
 			}
-
-			packetDelayCalculator.CalculateDelay(rtpPkt)
-
-			bitrateTrackers[t.Kind().String()].AddPacket(i, packetDelayCalculator)
+			arrival := time.Now()
 
 			if err = rtpPkt.Unmarshal(buf[:i]); err != nil {
 				mainLogger.Errorf("Failed to unmarshal incoming RTP packet: %v", err)
 				return
 			}
 
+			tracker.AddPacket(i, packetDelayCalculator.CalculateDelay(rtpPkt, arrival))
+			packetLog.packet(arrival, rtpPkt)
+
+			// Muted tracks still count as received, they are just not forwarded
+			if mute.muted.Load() {
+				continue
+			}
+
+			if audioLevelID != 0 {
+				if payload := rtpPkt.GetExtension(audioLevelID); payload != nil {
+					level := rtp.AudioLevelExtension{}
+					if err = level.Unmarshal(payload); err == nil {
+						speakers.observe(t.StreamID(), level)
+					}
+				}
+			}
+
 			rtpPkt.Extension = false
 			rtpPkt.Extensions = nil
 
+			if source != nil {
+				source.forward(rtpPkt)
+				continue
+			}
+
 			if err = trackLocal.WriteRTP(rtpPkt); err != nil {
 				return
 			}
@@ -741,6 +968,11 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		_, raw, err := c.ReadMessage()
 		if err != nil {
 			mainLogger.Errorf("Failed to read message: %v", err)
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				signalingErrors.inc(room, "read")
+			}
+			// The session can still be controlled on the control channel for a while
+			keepSession(state, closed)
 			return
 		}
 
@@ -748,6 +980,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 		if err := json.Unmarshal(raw, &message); err != nil {
 			mainLogger.Errorf("Failed to unmarshal json to message: %v", err)
+			signalingErrors.inc(room, "unmarshal-message")
 			return
 		}
 
@@ -756,6 +989,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			candidate := webrtc.ICECandidateInit{}
 			if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
 				mainLogger.Errorf("Failed to unmarshal json to candidate: %v", err)
+				signalingErrors.inc(room, "unmarshal-candidate")
 				return
 			}
 
@@ -763,12 +997,14 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 			if err := peerConnection.AddICECandidate(candidate); err != nil {
 				mainLogger.Errorf("Failed to add ICE candidate: %v", err)
+				signalingErrors.inc(room, "add-candidate")
 				return
 			}
 		case "answer":
 			answer := webrtc.SessionDescription{}
 			if err := json.Unmarshal([]byte(message.Data), &answer); err != nil {
 				mainLogger.Errorf("Failed to unmarshal json to answer: %v", err)
+				signalingErrors.inc(room, "unmarshal-answer")
 				return
 			}
 
@@ -776,10 +1012,37 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 			if err := peerConnection.SetRemoteDescription(answer); err != nil {
 				mainLogger.Errorf("Failed to set remote description: %v", err)
+				signalingErrors.inc(room, "set-remote-description")
 				return
 			}
+
+			// Now that we know the codecs of the peer send what was held back
+			if answerReceived(peerConnection) {
+				signalPeerConnections()
+			}
+		case "pin", "unpin":
+			// Data is the stream ID of the publisher to always (or no longer) receive
+			if err := setPinned(peerConnection, message.Data, message.Event == "pin"); err != nil {
+				mainLogger.Errorf("Failed to %s stream: %v", message.Event, err)
+			}
+		case "screen-share", "camera":
+			// Data is the ID of one of our own tracks, screen-share is prioritized by the allocator
+			if err := setScreenShare(peerConnection, message.Data, message.Event == "screen-share"); err != nil {
+				mainLogger.Errorf("Failed to mark track as %s: %v", message.Event, err)
+			}
+		case "mute", "unmute":
+			// Data is the ID of one of our own tracks, it is not forwarded while muted
+			if err := setMuted(peerConnection, message.Data, message.Event == "mute"); err != nil {
+				mainLogger.Errorf("Failed to %s track: %v", message.Event, err)
+			}
+		case "keyframe":
+			// Data is the ID of one of our down-tracks, empty for all of them
+			if err := requestKeyFrames(peerConnection, message.Data); err != nil {
+				mainLogger.Errorf("Failed to request keyframe: %v", err)
+			}
 		default:
 			mainLogger.Errorf("unknown message: %+v", message)
+			signalingErrors.inc(room, "unknown-event")
 		}
 	}
 }
@@ -796,3 +1059,12 @@ func (t *threadSafeWriter) WriteJSON(v interface{}) error {
 
 	return t.Conn.WriteJSON(v)
 }
+
+// closeWebsocket tells the client why the session ends before the connection is closed
+func closeWebsocket(c *threadSafeWriter, code int, reason string) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason)); err != nil {
+		mainLogger.Errorf("Failed to write close message: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// signalingErrors counts the signaling steps that failed, by room and reason
+var signalingErrors = &signalingErrorCounter{counts: map[[2]string]uint64{}}
+
+type signalingErrorCounter struct {
+	mu     sync.Mutex
+	counts map[[2]string]uint64
+}
+
+func (c *signalingErrorCounter) inc(room, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[[2]string{room, reason}]++
+}
+
+func (c *signalingErrorCounter) collect(f *metricFamily) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, count := range c.counts {
+		f.add(float64(count), "room", key[0], "reason", key[1])
+	}
+}
+
+// metricFamily is one metric in the Prometheus text format, with a sample per label set
+type metricFamily struct {
+	name    string
+	typ     string
+	help    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// add appends a sample, labels are name value pairs
+func (f *metricFamily) add(value float64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+	f.samples = append(f.samples, metricSample{labels: strings.Join(pairs, ","), value: value})
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// metrics holds the families of one scrape in the order they are written
+type metrics struct {
+	families []*metricFamily
+}
+
+func (m *metrics) family(name, typ, help string) *metricFamily {
+	f := &metricFamily{name: name, typ: typ, help: help}
+	m.families = append(m.families, f)
+	return f
+}
+
+func (m *metrics) write(w *bufio.Writer) error {
+	for _, f := range m.families {
+		sort.Slice(f.samples, func(i, j int) bool { return f.samples[i].labels < f.samples[j].labels })
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.samples {
+			value := strconv.FormatFloat(s.value, 'g', -1, 64)
+			if s.labels == "" {
+				fmt.Fprintf(w, "%s %s\n", f.name, value)
+			} else {
+				fmt.Fprintf(w, "%s{%s} %s\n", f.name, s.labels, value)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// collectMetrics reads the state of every room, peer and stream at scrape time
+func collectMetrics() *metrics {
+	m := &metrics{}
+	peers := m.family("sfu_peers", "gauge", "Connected peers.")
+	rooms := m.family("sfu_rooms", "gauge", "Rooms with at least one peer.")
+	tracks := m.family("sfu_tracks", "gauge", "Published tracks.")
+	target := m.family("sfu_bwe_target_bitrate_bps", "gauge", "Target bitrate of the bandwidth estimator of a subscriber.")
+	inBytes := m.family("sfu_inbound_bytes_total", "counter", "Bytes received from a publisher.")
+	inPackets := m.family("sfu_inbound_packets_total", "counter", "RTP packets received from a publisher.")
+	inLost := m.family("sfu_inbound_packets_lost", "gauge", "RTP packets from a publisher that never arrived.")
+	inJitter := m.family("sfu_inbound_jitter_seconds", "gauge", "Interarrival jitter of a publisher's stream.")
+	inNACKs := m.family("sfu_inbound_nacks_sent_total", "counter", "NACKs sent to a publisher.")
+	inPLIs := m.family("sfu_inbound_plis_sent_total", "counter", "PLIs sent to a publisher.")
+	outBytes := m.family("sfu_outbound_bytes_total", "counter", "Bytes sent to a subscriber.")
+	outPackets := m.family("sfu_outbound_packets_total", "counter", "RTP packets sent to a subscriber.")
+	outLost := m.family("sfu_outbound_packets_lost", "gauge", "RTP packets to a subscriber reported lost in receiver reports.")
+	outJitter := m.family("sfu_outbound_jitter_seconds", "gauge", "Interarrival jitter reported by a subscriber.")
+	outNACKs := m.family("sfu_outbound_nacks_received_total", "counter", "NACKs received from a subscriber.")
+	outPLIs := m.family("sfu_outbound_plis_received_total", "counter", "PLIs received from a subscriber.")
+	signaling := m.family("sfu_signaling_errors_total", "counter", "Signaling steps that failed.")
+
+	listLock.RLock()
+	defer listLock.RUnlock()
+
+	peersPerRoom := map[string]int{}
+	for _, p := range peerConnections {
+		if p.peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			continue
+		}
+		peersPerRoom[p.room]++
+		target.add(float64(p.estimator.GetTargetBitrate()), "room", p.room, "peer", p.id, "estimator", p.bwe.name)
+		if p.statsGetter == nil {
+			continue
+		}
+
+		for _, receiver := range p.peerConnection.GetReceivers() {
+			t := receiver.Track()
+			if t == nil {
+				continue
+			}
+			s := p.statsGetter.Get(uint32(t.SSRC()))
+			if s == nil {
+				continue
+			}
+			labels := []string{"room", p.room, "peer", p.id, "track", t.ID(), "ssrc", strconv.FormatUint(uint64(t.SSRC()), 10), "kind", t.Kind().String(), "codec", t.Codec().MimeType}
+			inBytes.add(float64(s.InboundRTPStreamStats.BytesReceived), labels...)
+			inPackets.add(float64(s.InboundRTPStreamStats.PacketsReceived), labels...)
+			inLost.add(float64(s.InboundRTPStreamStats.PacketsLost), labels...)
+			if clockRate := t.Codec().ClockRate; clockRate != 0 {
+				// Jitter is in RTP timestamp units
+				inJitter.add(s.InboundRTPStreamStats.Jitter/float64(clockRate), labels...)
+			}
+			inNACKs.add(float64(s.InboundRTPStreamStats.NACKCount), labels...)
+			inPLIs.add(float64(s.InboundRTPStreamStats.PLICount), labels...)
+		}
+
+		for _, sender := range p.peerConnection.GetSenders() {
+			t := sender.Track()
+			if t == nil {
+				continue
+			}
+			codec := ""
+			if codecs := sender.GetParameters().Codecs; len(codecs) != 0 {
+				codec = codecs[0].MimeType
+			}
+			for _, encoding := range sender.GetParameters().Encodings {
+				s := p.statsGetter.Get(uint32(encoding.SSRC))
+				if s == nil {
+					continue
+				}
+				labels := []string{"room", p.room, "peer", p.id, "track", t.ID(), "ssrc", strconv.FormatUint(uint64(encoding.SSRC), 10), "kind", t.Kind().String(), "codec", codec}
+				outBytes.add(float64(s.OutboundRTPStreamStats.BytesSent), labels...)
+				outPackets.add(float64(s.OutboundRTPStreamStats.PacketsSent), labels...)
+				outLost.add(float64(s.RemoteInboundRTPStreamStats.PacketsLost), labels...)
+				outJitter.add(s.RemoteInboundRTPStreamStats.Jitter, labels...)
+				outNACKs.add(float64(s.OutboundRTPStreamStats.NACKCount), labels...)
+				outPLIs.add(float64(s.OutboundRTPStreamStats.PLICount), labels...)
+			}
+		}
+	}
+	for room, count := range peersPerRoom {
+		peers.add(float64(count), "room", room)
+	}
+	rooms.add(float64(len(peersPerRoom)))
+
+	tracksPerRoom := map[[3]string]int{}
+	for id, trackLocal := range trackLocals {
+		tracksPerRoom[[3]string{trackRooms[id], trackLocal.Kind().String(), trackLocal.Codec().MimeType}]++
+	}
+	for _, source := range videoSources {
+		tracksPerRoom[[3]string{source.room, webrtc.RTPCodecTypeVideo.String(), source.codec.MimeType}]++
+	}
+	for key, count := range tracksPerRoom {
+		tracks.add(float64(count), "room", key[0], "kind", key[1], "codec", key[2])
+	}
+
+	signalingErrors.collect(signaling)
+	return m
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	m := collectMetrics()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.write(bufio.NewWriter(w)); err != nil {
+		mainLogger.Errorf("Failed to write metrics: %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+// Default parameters from RFC 8698 Figure 3, the ones in nadaConfig can be tuned
+const (
+	nadaPrio       = 1.0
+	nadaXRef       = 10 * time.Millisecond
+	nadaKappa      = 0.5
+	nadaEta        = 2.0
+	nadaTau        = 500 * time.Millisecond
+	nadaDelta      = 100 * time.Millisecond
+	nadaLogWin     = 500 * time.Millisecond
+	nadaQEps       = 10 * time.Millisecond
+	nadaDFilt      = 120 * time.Millisecond
+	nadaGammaMax   = 0.5
+	nadaQBound     = 50 * time.Millisecond
+	nadaMultiLoss  = 7.0
+	nadaQTh        = 50 * time.Millisecond
+	nadaLambda     = 0.5
+	nadaPLRRef     = 0.01
+	nadaDLoss      = 10 * time.Millisecond
+	nadaAlpha      = 0.1
+	nadaMinFilter  = 15
+	nadaBaseWindow = 10 * time.Minute
+	nadaRTTWindow  = 10 * time.Second
+)
+
+// Rate update modes
+const (
+	nadaAcceleratedRampUp = "accelerated"
+	nadaGradualUpdate     = "gradual"
+)
+
+// nadaConfig tunes the gradual rate update, zero values take the defaults
+type nadaConfig struct {
+	Prio float64 `json:"prio"`
+	// XRef is the reference congestion level in milliseconds
+	XRef  float64 `json:"xRef"`
+	Kappa float64 `json:"kappa"`
+	Eta   float64 `json:"eta"`
+	// Tau is the upper bound of the RTT used in the gradual update, in milliseconds
+	Tau float64 `json:"tau"`
+}
+
+func (c *nadaConfig) setDefaults() {
+	if c.Prio == 0 {
+		c.Prio = nadaPrio
+	}
+	if c.XRef == 0 {
+		c.XRef = float64(nadaXRef.Milliseconds())
+	}
+	if c.Kappa == 0 {
+		c.Kappa = nadaKappa
+	}
+	if c.Eta == 0 {
+		c.Eta = nadaEta
+	}
+	if c.Tau == 0 {
+		c.Tau = float64(nadaTau.Milliseconds())
+	}
+}
+
+type nadaArrival struct {
+	arrival time.Time
+	size    int
+}
+
+type nadaRTTSample struct {
+	at  time.Time
+	rtt time.Duration
+}
+
+// nadaEstimator is a sender-side implementation of NADA (RFC 8698), driven by the same TWCC
+// feedback as GCC. The aggregate congestion signal combines the queuing delay with a
+// penalty for loss, the reference rate then either ramps up quickly while the path is
+// clearly uncongested or follows the delay based gradual update.
+type nadaEstimator struct {
+	pacer    gcc.Pacer
+	feedback *twccFeedback
+	params   nadaConfig
+
+	minBitrate int
+	maxBitrate int
+
+	mu       sync.Mutex
+	onChange func(bitrate int)
+
+	refRate     float64
+	recvRate    float64
+	baseDelay   time.Duration
+	baseSince   time.Time
+	recent      []time.Duration
+	queueDelay  time.Duration
+	lossRatio   float64
+	signal      time.Duration
+	prevSignal  time.Duration
+	rtt         time.Duration
+	rtts        []nadaRTTSample
+	mode        string
+	lastUpdate  time.Time
+	lastLoss    time.Time
+	arrivals    []nadaArrival
+	lastArrival time.Time
+	started     bool
+}
+
+func newNADAEstimator(cfg bweConfig, pacer gcc.Pacer) *nadaEstimator {
+	e := &nadaEstimator{
+		pacer:      pacer,
+		feedback:   newTWCCFeedback(),
+		params:     cfg.NADA,
+		minBitrate: cfg.MinBitrate,
+		maxBitrate: cfg.MaxBitrate,
+		refRate:    float64(cfg.InitialBitrate),
+		mode:       nadaAcceleratedRampUp,
+	}
+	if e.minBitrate == 0 {
+		e.minBitrate = 150_000
+	}
+	if e.maxBitrate == 0 {
+		e.maxBitrate = 50_000_000
+	}
+	e.params.setDefaults()
+	pacer.SetTargetBitrate(cfg.InitialBitrate)
+	return e
+}
+
+// AddStream records the departure of every packet before it is paced out
+func (e *nadaEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	var twccExtID uint8
+	for _, ext := range info.RTPHeaderExtensions {
+		if ext.URI == sdp.TransportCCURI {
+			twccExtID = uint8(ext.ID)
+		}
+	}
+
+	e.pacer.AddStream(info.SSRC, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		e.feedback.onSent(time.Now(), header, len(payload), twccExtID)
+		return writer.Write(header, payload, attributes)
+	}))
+	return e.pacer
+}
+
+// WriteRTCP feeds TWCC feedback into the estimator
+func (e *nadaEstimator) WriteRTCP(pkts []rtcp.Packet, _ interceptor.Attributes) error {
+	for _, pkt := range pkts {
+		if fb, ok := pkt.(*rtcp.TransportLayerCC); ok {
+			e.update(time.Now(), e.feedback.onTransportCCFeedback(fb))
+		}
+	}
+	return nil
+}
+
+// update runs one NADA rate update for the packets a feedback message reported on
+func (e *nadaEstimator) update(now time.Time, results []packetResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	lost, received := 0, 0
+	for _, r := range results {
+		if !r.Received {
+			lost++
+			continue
+		}
+		received++
+
+		// One-way delay with an unknown clock offset, which cancels out against the base delay
+		delay := r.Arrival.Sub(r.Departure)
+		if e.baseSince.IsZero() || delay < e.baseDelay || now.Sub(e.baseSince) > nadaBaseWindow {
+			e.baseDelay, e.baseSince = delay, now
+		}
+		e.recent = append(e.recent, delay-e.baseDelay)
+		if len(e.recent) > nadaMinFilter {
+			e.recent = e.recent[1:]
+		}
+
+		e.arrivals = append(e.arrivals, nadaArrival{arrival: r.Arrival, size: r.Size})
+		if r.Arrival.After(e.lastArrival) {
+			e.lastArrival = r.Arrival
+		}
+		e.addRTT(now, now.Sub(r.Departure))
+	}
+
+	// Minimum filter against spikes from the delay samples (RFC 8698 4.2)
+	if len(e.recent) != 0 {
+		e.queueDelay = e.recent[0]
+		for _, d := range e.recent[1:] {
+			e.queueDelay = min(e.queueDelay, d)
+		}
+	}
+
+	e.lossRatio = nadaAlpha*float64(lost)/float64(lost+received) + (1-nadaAlpha)*e.lossRatio
+	if lost != 0 {
+		e.lastLoss = now
+	}
+
+	// Receiving rate over the last LOGWIN of arrivals
+	for len(e.arrivals) != 0 && e.lastArrival.Sub(e.arrivals[0].arrival) > nadaLogWin {
+		e.arrivals = e.arrivals[1:]
+	}
+	bytes := 0
+	for _, a := range e.arrivals {
+		bytes += a.size
+	}
+	e.recvRate = float64(bytes*8) / nadaLogWin.Seconds()
+
+	// Aggregate congestion signal, queuing delay is warped down once loss shows up (RFC 8698 4.2)
+	queueDelay := e.queueDelay
+	recentLoss := !e.lastLoss.IsZero() && now.Sub(e.lastLoss) < nadaMultiLoss*nadaDelta
+	if recentLoss && queueDelay > nadaQTh {
+		queueDelay = time.Duration(float64(nadaQTh) * math.Exp(-nadaLambda*float64(queueDelay-nadaQTh)/float64(nadaQTh)))
+	}
+	e.prevSignal = e.signal
+	e.signal = queueDelay + time.Duration(float64(nadaDLoss)*math.Pow(e.lossRatio/nadaPLRRef, 2))
+
+	delta := nadaDelta
+	if e.started {
+		delta = min(now.Sub(e.lastUpdate), 2*nadaDelta)
+	}
+	e.lastUpdate = now
+
+	if !recentLoss && e.queueDelay < nadaQEps {
+		e.mode = nadaAcceleratedRampUp
+		gamma := math.Min(nadaGammaMax, float64(nadaQBound)/float64(e.rtt+nadaDelta+nadaDFilt))
+		e.refRate = math.Max(e.refRate, (1+gamma)*e.recvRate)
+	} else if e.started {
+		e.mode = nadaGradualUpdate
+		tau := e.params.Tau / 1000
+		offset := e.signal.Seconds() - e.params.Prio*e.params.XRef/1000*float64(e.maxBitrate)/e.refRate
+		diff := (e.signal - e.prevSignal).Seconds()
+		e.refRate -= e.params.Kappa * (delta.Seconds() / tau) * (offset / tau) * e.refRate
+		e.refRate -= e.params.Kappa * e.params.Eta * (diff / tau) * e.refRate
+	}
+	e.started = true
+
+	e.refRate = math.Max(float64(e.minBitrate), math.Min(float64(e.maxBitrate), e.refRate))
+	bitrate := int(e.refRate)
+	onChange := e.onChange
+	e.mu.Unlock()
+
+	e.pacer.SetTargetBitrate(bitrate)
+	if onChange != nil {
+		go onChange(bitrate)
+	}
+}
+
+// addRTT keeps the minimum RTT of the last nadaRTTWindow, so the RTT can go up again. Samples
+// are kept in increasing order, the first one is the minimum. Must hold e.mu.
+func (e *nadaEstimator) addRTT(now time.Time, rtt time.Duration) {
+	for len(e.rtts) != 0 && e.rtts[len(e.rtts)-1].rtt >= rtt {
+		e.rtts = e.rtts[:len(e.rtts)-1]
+	}
+	e.rtts = append(e.rtts, nadaRTTSample{at: now, rtt: rtt})
+	for now.Sub(e.rtts[0].at) > nadaRTTWindow {
+		e.rtts = e.rtts[1:]
+	}
+	e.rtt = e.rtts[0].rtt
+}
+
+// replaySent records a packet of a replayed trace at the time it was sent
+func (e *nadaEstimator) replaySent(at time.Time, seq uint16, ssrc uint32, size int) {
+	e.feedback.onSentSequence(at, seq, ssrc, size)
+}
+
+// replayFeedback runs the rate update for a feedback of a replayed trace at the time it was received
+func (e *nadaEstimator) replayFeedback(at time.Time, fb *rtcp.TransportLayerCC) {
+	e.update(at, e.feedback.onTransportCCFeedback(fb))
+}
+
+// GetTargetBitrate returns the current reference rate in bits per second
+func (e *nadaEstimator) GetTargetBitrate() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return int(e.refRate)
+}
+
+// OnTargetBitrateChange sets the callback that is called after every rate update
+func (e *nadaEstimator) OnTargetBitrateChange(f func(bitrate int)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onChange = f
+}
+
+// GetStats returns the internal state of the estimator
+func (e *nadaEstimator) GetStats() map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return map[string]interface{}{
+		"targetBitrate":  int(e.refRate),
+		"receiveBitrate": int(e.recvRate),
+		"queueDelay":     float64(e.queueDelay.Microseconds()) / 1000.0,
+		"baseDelay":      float64(e.baseDelay.Microseconds()) / 1000.0,
+		"signal":         float64(e.signal.Microseconds()) / 1000.0,
+		"lossRatio":      e.lossRatio,
+		"rtt":            float64(e.rtt.Microseconds()) / 1000.0,
+		"mode":           e.mode,
+	}
+}
+
+// Close stops the pacer
+func (e *nadaEstimator) Close() error {
+	return e.pacer.Close()
+}
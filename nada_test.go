@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+type testPacer struct {
+	target int
+}
+
+func (p *testPacer) Write(*rtp.Header, []byte, interceptor.Attributes) (int, error) { return 0, nil }
+func (p *testPacer) AddStream(uint32, interceptor.RTPWriter)                        {}
+func (p *testPacer) SetTargetBitrate(bitrate int)                                   { p.target = bitrate }
+func (p *testPacer) Close() error                                                   { return nil }
+
+const testPacketSize = 1200
+
+// simulateNADA sends at the target bitrate for the given duration and feeds the estimator one
+// feedback every 100ms. queueDelay and lost describe the path for a packet sent at t.
+func simulateNADA(e *nadaEstimator, start time.Time, duration time.Duration, queueDelay func(t time.Duration) time.Duration, lost func(i int) bool) time.Time {
+	const baseDelay = 20 * time.Millisecond
+	i := 0
+	for t := time.Duration(0); t < duration; t += nadaDelta {
+		count := max(1, int(float64(e.GetTargetBitrate())*nadaDelta.Seconds()/8/testPacketSize))
+		results := make([]packetResult, 0, count)
+		for j := 0; j < count; j++ {
+			sent := t + nadaDelta*time.Duration(j)/time.Duration(count)
+			result := packetResult{
+				SequenceNumber: uint16(i),
+				Size:           testPacketSize,
+				Departure:      start.Add(sent),
+			}
+			if !lost(i) {
+				result.Received = true
+				result.Arrival = start.Add(sent + baseDelay + queueDelay(sent))
+			}
+			results = append(results, result)
+			i++
+		}
+		e.update(start.Add(t+nadaDelta+baseDelay), results)
+	}
+	return start.Add(duration)
+}
+
+func noQueue(time.Duration) time.Duration { return 0 }
+
+func noLoss(int) bool { return false }
+
+func newTestNADA(initial, minBitrate, maxBitrate int) (*nadaEstimator, *testPacer) {
+	pacer := &testPacer{}
+	return newNADAEstimator(bweConfig{InitialBitrate: initial, MinBitrate: minBitrate, MaxBitrate: maxBitrate}, pacer), pacer
+}
+
+func TestNADARampsUpWithoutQueuing(t *testing.T) {
+	e, pacer := newTestNADA(500_000, 150_000, 5_000_000)
+	simulateNADA(e, time.Now(), 10*time.Second, noQueue, noLoss)
+
+	if got := e.GetTargetBitrate(); got <= 500_000 {
+		t.Fatalf("expected the target to ramp up from 500000, got %d", got)
+	}
+	if mode := e.GetStats()["mode"]; mode != nadaAcceleratedRampUp {
+		t.Fatalf("expected accelerated ramp-up, got %v", mode)
+	}
+	if pacer.target != e.GetTargetBitrate() {
+		t.Fatalf("pacer target %d does not follow the estimate %d", pacer.target, e.GetTargetBitrate())
+	}
+}
+
+func TestNADADecreasesOnQueuingDelay(t *testing.T) {
+	e, _ := newTestNADA(2_000_000, 150_000, 5_000_000)
+	now := simulateNADA(e, time.Now(), 2*time.Second, noQueue, noLoss)
+	before := e.GetTargetBitrate()
+
+	growing := func(t time.Duration) time.Duration { return t / 10 }
+	simulateNADA(e, now, 3*time.Second, growing, noLoss)
+
+	if got := e.GetTargetBitrate(); got >= before {
+		t.Fatalf("expected the target to drop below %d on growing delay, got %d", before, got)
+	}
+	if mode := e.GetStats()["mode"]; mode != nadaGradualUpdate {
+		t.Fatalf("expected gradual update, got %v", mode)
+	}
+}
+
+func TestNADADecreasesOnLoss(t *testing.T) {
+	e, _ := newTestNADA(2_000_000, 150_000, 5_000_000)
+	now := simulateNADA(e, time.Now(), 2*time.Second, noQueue, noLoss)
+	before := e.GetTargetBitrate()
+
+	simulateNADA(e, now, 3*time.Second, noQueue, func(i int) bool { return i%10 == 0 })
+
+	if got := e.GetTargetBitrate(); got >= before {
+		t.Fatalf("expected the target to drop below %d on 10%% loss, got %d", before, got)
+	}
+	if loss := e.GetStats()["lossRatio"].(float64); loss < 0.05 {
+		t.Fatalf("expected a smoothed loss ratio near 0.1, got %f", loss)
+	}
+}
+
+func TestNADAStaysWithinBounds(t *testing.T) {
+	e, _ := newTestNADA(1_000_000, 300_000, 1_500_000)
+	now := simulateNADA(e, time.Now(), 10*time.Second, noQueue, noLoss)
+	if got := e.GetTargetBitrate(); got != 1_500_000 {
+		t.Fatalf("expected the target to be capped at 1500000, got %d", got)
+	}
+
+	congested := func(time.Duration) time.Duration { return 400 * time.Millisecond }
+	simulateNADA(e, now, 20*time.Second, congested, func(i int) bool { return i%4 == 0 })
+	if got := e.GetTargetBitrate(); got != 300_000 {
+		t.Fatalf("expected the target to be floored at 300000, got %d", got)
+	}
+}
+
+func TestNADARTTExpires(t *testing.T) {
+	e, _ := newTestNADA(1_000_000, 150_000, 5_000_000)
+	start := time.Now()
+	e.addRTT(start, 10*time.Millisecond)
+	for i := 1; i <= 15; i++ {
+		e.addRTT(start.Add(time.Duration(i)*time.Second), 50*time.Millisecond)
+		if i <= 10 && e.rtt != 10*time.Millisecond {
+			t.Fatalf("expected the 10ms minimum to hold within the window, got %s after %ds", e.rtt, i)
+		}
+	}
+	if e.rtt != 50*time.Millisecond {
+		t.Fatalf("expected the RTT to follow up to 50ms, got %s", e.rtt)
+	}
+	if len(e.rtts) != 1 {
+		t.Fatalf("expected only the minimum to be kept, got %d samples", len(e.rtts))
+	}
+}
+
+func TestTWCCFeedbackMatchesSentPackets(t *testing.T) {
+	const twccExtID = 5
+	f := newTWCCFeedback()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		header := &rtp.Header{SSRC: 1234}
+		ext, err := (&rtp.TransportCCExtension{TransportSequence: uint16(100 + i)}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = header.SetExtension(twccExtID, ext); err != nil {
+			t.Fatal(err)
+		}
+		f.onSent(start.Add(time.Duration(i)*10*time.Millisecond), header, 1000, twccExtID)
+	}
+
+	// 100 and 102 received 10ms and 25ms after the reference time, 101 lost
+	results := f.onTransportCCFeedback(&rtcp.TransportLayerCC{
+		BaseSequenceNumber: 100,
+		PacketStatusCount:  3,
+		ReferenceTime:      1,
+		PacketChunks: []rtcp.PacketStatusChunk{
+			&rtcp.StatusVectorChunk{
+				SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit,
+				SymbolList: []uint16{rtcp.TypeTCCPacketReceivedSmallDelta, rtcp.TypeTCCPacketNotReceived, rtcp.TypeTCCPacketReceivedSmallDelta},
+			},
+		},
+		RecvDeltas: []*rtcp.RecvDelta{
+			{Type: rtcp.TypeTCCPacketReceivedSmallDelta, Delta: 10_000},
+			{Type: rtcp.TypeTCCPacketReceivedSmallDelta, Delta: 15_000},
+		},
+	})
+
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if !results[0].Received || results[1].Received || !results[2].Received {
+		t.Fatalf("unexpected received flags %+v", results)
+	}
+	if results[0].SSRC != 1234 || results[0].Size <= 1000 {
+		t.Fatalf("sent packet not matched: %+v", results[0])
+	}
+	if d := results[2].Arrival.Sub(results[0].Arrival); d != 15*time.Millisecond {
+		t.Fatalf("expected 15ms between arrivals, got %s", d)
+	}
+	if d := results[2].Departure.Sub(results[0].Departure); d != 20*time.Millisecond {
+		t.Fatalf("expected 20ms between departures, got %s", d)
+	}
+}
@@ -0,0 +1,289 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+// outboundColumns are the CSV columns of an outboundSample, see statsColumns
+var outboundColumns = []string{
+	"timestamp", "experiment", "room", "peer", "track", "source", "ssrc", "kind",
+	"packets_sent", "sent_kbps", "nacks_received", "plis_received",
+	"rr_fraction_lost", "rr_packets_lost", "rr_jitter_ms", "rtt_ms",
+	"twcc_packets_reported", "twcc_packets_lost", "twcc_loss_ratio",
+	"target_kbps",
+	"client_width", "client_height", "client_fps", "client_bitrate_kbps",
+}
+
+// outboundSample is one tick of a stream we send a subscriber. Counters are deltas over the
+// tick. The rr_ values come from the subscriber's receiver reports, the twcc_ ones from its
+// TWCC feedback.
+type outboundSample struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Experiment string    `json:"experiment"`
+	Room       string    `json:"room"`
+	Peer       string    `json:"peer"`
+	Track      string    `json:"track"`
+	// Source is the publisher track the down-track forwards
+	Source string `json:"source"`
+	SSRC   uint32 `json:"ssrc"`
+	Kind   string `json:"kind"`
+
+	PacketsSent   uint64  `json:"packets_sent"`
+	SentKbps      float64 `json:"sent_kbps"`
+	NACKsReceived uint32  `json:"nacks_received"`
+	PLIsReceived  uint32  `json:"plis_received"`
+
+	RRFractionLost float64 `json:"rr_fraction_lost"`
+	RRPacketsLost  int64   `json:"rr_packets_lost"`
+	RRJitterMs     float64 `json:"rr_jitter_ms"`
+	RTTMs          float64 `json:"rtt_ms"`
+
+	TWCCPacketsReported uint64  `json:"twcc_packets_reported"`
+	TWCCPacketsLost     uint64  `json:"twcc_packets_lost"`
+	TWCCLossRatio       float64 `json:"twcc_loss_ratio"`
+
+	// TargetKbps is the target of the subscriber's estimator, shared by all its down-tracks
+	TargetKbps float64 `json:"target_kbps"`
+
+	// What the subscriber last reported about rendering this track, null without a recent report
+	ClientWidth       *int     `json:"client_width"`
+	ClientHeight      *int     `json:"client_height"`
+	ClientFrameRate   *float64 `json:"client_fps"`
+	ClientBitrateKbps *float64 `json:"client_bitrate_kbps"`
+}
+
+func (s *outboundSample) row() []string {
+	return []string{
+		s.Timestamp.Format(time.RFC3339Nano), s.Experiment, s.Room, s.Peer, s.Track, s.Source,
+		strconv.FormatUint(uint64(s.SSRC), 10), s.Kind,
+		strconv.FormatUint(s.PacketsSent, 10), formatNumber(s.SentKbps),
+		strconv.FormatUint(uint64(s.NACKsReceived), 10), strconv.FormatUint(uint64(s.PLIsReceived), 10),
+		strconv.FormatFloat(s.RRFractionLost, 'f', 4, 64), strconv.FormatInt(s.RRPacketsLost, 10),
+		formatNumber(s.RRJitterMs), formatNumber(s.RTTMs),
+		strconv.FormatUint(s.TWCCPacketsReported, 10), strconv.FormatUint(s.TWCCPacketsLost, 10),
+		strconv.FormatFloat(s.TWCCLossRatio, 'f', 4, 64),
+		formatNumber(s.TargetKbps),
+		formatOptionalInt(s.ClientWidth), formatOptionalInt(s.ClientHeight), formatOptional(s.ClientFrameRate), formatOptional(s.ClientBitrateKbps),
+	}
+}
+
+// twccCounts is what TWCC feedback reported about the packets of one SSRC so far
+type twccCounts struct {
+	reported uint64
+	lost     uint64
+}
+
+// outboundTWCCFactory creates an outboundTWCC per PeerConnection
+type outboundTWCCFactory struct {
+	onNewPeerConnection func(id string, o *outboundTWCC)
+}
+
+// OnNewPeerConnection sets a callback that is called when a new outboundTWCC is created
+func (f *outboundTWCCFactory) OnNewPeerConnection(cb func(id string, o *outboundTWCC)) {
+	f.onNewPeerConnection = cb
+}
+
+// NewInterceptor returns a new outboundTWCC
+func (f *outboundTWCCFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	o := &outboundTWCC{feedback: newTWCCFeedback(), counts: map[uint32]twccCounts{}}
+	if f.onNewPeerConnection != nil {
+		f.onNewPeerConnection(id, o)
+	}
+	return o, nil
+}
+
+// outboundTWCC splits the TWCC feedback of a subscriber by SSRC, so loss can be told
+// apart per down-track. It has to see packets after the transport-wide sequence number is set.
+type outboundTWCC struct {
+	interceptor.NoOp
+	feedback *twccFeedback
+
+	mu     sync.Mutex
+	counts map[uint32]twccCounts
+}
+
+// BindLocalStream remembers the packets of streams that carry the transport-wide sequence number
+func (o *outboundTWCC) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	var twccExtID uint8
+	for _, ext := range info.RTPHeaderExtensions {
+		if ext.URI == sdp.TransportCCURI {
+			twccExtID = uint8(ext.ID)
+		}
+	}
+	if twccExtID == 0 {
+		return writer
+	}
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		o.feedback.onSent(time.Now(), header, len(payload), twccExtID)
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+// BindRTCPReader counts the packets TWCC feedback reports received or lost
+func (o *outboundTWCC) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		i, attr, err := reader.Read(b, a)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if attr == nil {
+			attr = make(interceptor.Attributes)
+		}
+		pkts, err := attr.GetRTCPPackets(b[:i])
+		if err != nil {
+			return i, attr, nil //nolint: nilerr
+		}
+
+		for _, pkt := range pkts {
+			if fb, ok := pkt.(*rtcp.TransportLayerCC); ok {
+				o.count(o.feedback.onTransportCCFeedback(fb))
+			}
+		}
+		return i, attr, nil
+	})
+}
+
+func (o *outboundTWCC) count(results []packetResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, result := range results {
+		c := o.counts[result.SSRC]
+		c.reported++
+		if !result.Received {
+			c.lost++
+		}
+		o.counts[result.SSRC] = c
+	}
+}
+
+// get returns the counts of an SSRC so far
+func (o *outboundTWCC) get(ssrc uint32) twccCounts {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.counts[ssrc]
+}
+
+// outboundCounters are the totals of a down-track at the previous tick
+type outboundCounters struct {
+	packets uint64
+	bytes   uint64
+	nacks   uint32
+	plis    uint32
+	lost    int64
+	twcc    twccCounts
+}
+
+// outboundStats turns the totals of every down-track of a subscriber into per tick samples
+type outboundStats struct {
+	experiment string
+	getter     stats.Getter
+	twcc       *outboundTWCC
+
+	lastTick time.Time
+	last     map[uint32]outboundCounters
+}
+
+func newOutboundStats(experiment string, getter stats.Getter, twcc *outboundTWCC) *outboundStats {
+	return &outboundStats{experiment: experiment, getter: getter, twcc: twcc, last: map[uint32]outboundCounters{}}
+}
+
+// sample returns a sample of every down-track of p. Must hold listLock.
+func (o *outboundStats) sample(now time.Time, p *peerConnectionState) []*outboundSample {
+	interval := now.Sub(o.lastTick).Seconds()
+	if o.lastTick.IsZero() {
+		interval = 0
+	}
+	o.lastTick = now
+
+	sources := map[string]string{}
+	for _, d := range p.downTracks {
+		if source := d.currentSource(); source != nil {
+			sources[d.track.ID()] = source.id
+		}
+	}
+
+	targetKbps := float64(p.estimator.GetTargetBitrate()) / 1000
+	samples := []*outboundSample{}
+	last := map[uint32]outboundCounters{}
+	for _, sender := range p.peerConnection.GetSenders() {
+		t := sender.Track()
+		if t == nil {
+			continue
+		}
+		encodings := sender.GetParameters().Encodings
+		if len(encodings) == 0 {
+			continue
+		}
+		ssrc := uint32(encodings[0].SSRC)
+		s := o.getter.Get(ssrc)
+		if s == nil {
+			continue
+		}
+
+		// Audio is fanned out through the publisher's track, so it is its own source
+		source, ok := sources[t.ID()]
+		if !ok && !p.hasDownTrack(t.ID()) {
+			source = t.ID()
+		}
+
+		current := outboundCounters{
+			packets: s.OutboundRTPStreamStats.PacketsSent,
+			bytes:   s.OutboundRTPStreamStats.BytesSent,
+			nacks:   s.OutboundRTPStreamStats.NACKCount,
+			plis:    s.OutboundRTPStreamStats.PLICount,
+			lost:    s.RemoteInboundRTPStreamStats.PacketsLost,
+			twcc:    o.twcc.get(ssrc),
+		}
+		previous := o.last[ssrc]
+		last[ssrc] = current
+
+		sample := &outboundSample{
+			Timestamp:           now,
+			Experiment:          o.experiment,
+			Room:                p.room,
+			Peer:                p.id,
+			Track:               t.ID(),
+			Source:              source,
+			SSRC:                ssrc,
+			Kind:                t.Kind().String(),
+			PacketsSent:         current.packets - previous.packets,
+			NACKsReceived:       current.nacks - previous.nacks,
+			PLIsReceived:        current.plis - previous.plis,
+			RRFractionLost:      s.RemoteInboundRTPStreamStats.FractionLost,
+			RRPacketsLost:       current.lost - previous.lost,
+			RRJitterMs:          s.RemoteInboundRTPStreamStats.Jitter * 1000,
+			RTTMs:               float64(s.RemoteInboundRTPStreamStats.RoundTripTime.Microseconds()) / 1000.0,
+			TWCCPacketsReported: current.twcc.reported - previous.twcc.reported,
+			TWCCPacketsLost:     current.twcc.lost - previous.twcc.lost,
+			TargetKbps:          targetKbps,
+		}
+		if interval > 0 {
+			sample.SentKbps = float64((current.bytes-previous.bytes)*8) / 1000 / interval
+		}
+		if sample.TWCCPacketsReported != 0 {
+			sample.TWCCLossRatio = float64(sample.TWCCPacketsLost) / float64(sample.TWCCPacketsReported)
+		}
+		p.client.merge(sample, now)
+		samples = append(samples, sample)
+	}
+
+	// Down-tracks that went away start from zero if they come back
+	o.last = last
+	return samples
+}
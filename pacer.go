@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtp"
+)
+
+// Packets queued beyond this are dropped instead of growing the pacer queue forever
+const maxPacerQueue = 2000
+
+// PacerStats are the counters of a subscriber's pacer
+type PacerStats struct {
+	QueueDepth int64  `json:"queueDepth"`
+	Sent       uint64 `json:"sent"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+// pacer wraps a LeakyBucketPacer so queue depth and drops can be observed.
+// Each subscriber PeerConnection owns one, passed to its send-side BWE which
+// keeps the pacing rate at the connection's target bitrate.
+type pacer struct {
+	*gcc.LeakyBucketPacer
+
+	mu    sync.RWMutex
+	ssrcs map[uint32]bool
+
+	queued    atomic.Int64
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+	closeOnce sync.Once
+}
+
+func newPacer(initialBitrate int) *pacer {
+	return &pacer{
+		LeakyBucketPacer: gcc.NewLeakyBucketPacer(initialBitrate),
+		ssrcs:            map[uint32]bool{},
+	}
+}
+
+// AddStream registers the writer of a stream, counting every packet that leaves the queue.
+// Packets of a stream removed while they were queued are dropped.
+func (p *pacer) AddStream(ssrc uint32, writer interceptor.RTPWriter) {
+	// The inner pacer drops packets it has no writer for without telling, so it gets the
+	// writer before we accept any
+	p.LeakyBucketPacer.AddStream(ssrc, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		p.queued.Add(-1)
+		p.mu.RLock()
+		known := p.ssrcs[header.SSRC]
+		p.mu.RUnlock()
+		if !known {
+			p.dropped.Add(1)
+			return 0, nil
+		}
+
+		n, err := writer.Write(header, payload, attributes)
+		if err != nil {
+			p.dropped.Add(1)
+			return n, err
+		}
+		p.sent.Add(1)
+		return n, nil
+	}))
+
+	p.mu.Lock()
+	p.ssrcs[ssrc] = true
+	p.mu.Unlock()
+}
+
+// RemoveStream stops accepting packets of a stream. The inner pacer can't forget its
+// writer, but that only drops what is still queued.
+func (p *pacer) RemoveStream(ssrc uint32) {
+	p.mu.Lock()
+	delete(p.ssrcs, ssrc)
+	p.mu.Unlock()
+}
+
+// Write queues a packet, unless the stream is unknown or the queue is full
+func (p *pacer) Write(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+	p.mu.RLock()
+	known := p.ssrcs[header.SSRC]
+	p.mu.RUnlock()
+
+	if !known || p.queued.Load() >= maxPacerQueue {
+		p.dropped.Add(1)
+		return header.MarshalSize() + len(payload), nil
+	}
+
+	p.queued.Add(1)
+	n, err := p.LeakyBucketPacer.Write(header, payload, attributes)
+	if err != nil {
+		p.queued.Add(-1)
+		p.dropped.Add(1)
+	}
+	return n, err
+}
+
+// Close stops the pacer, it is safe to call more than once
+func (p *pacer) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		err = p.LeakyBucketPacer.Close()
+	})
+	return err
+}
+
+// Stats returns a snapshot of the pacer counters
+func (p *pacer) Stats() PacerStats {
+	return PacerStats{
+		QueueDepth: p.queued.Load(),
+		Sent:       p.sent.Load(),
+		Dropped:    p.dropped.Load(),
+	}
+}
+
+// NewInterceptor lets the pacer see its streams being unbound, the congestion controller
+// never removes them
+func (p *pacer) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &pacerStreams{pacer: p}, nil
+}
+
+// pacerStreams removes unbound streams from the pacer
+type pacerStreams struct {
+	interceptor.NoOp
+	pacer *pacer
+}
+
+func (s *pacerStreams) UnbindLocalStream(info *interceptor.StreamInfo) {
+	s.pacer.RemoveStream(info.SSRC)
+}
@@ -1,19 +1,21 @@
+import sys
+
 import pandas as pd
 import matplotlib.pyplot as plt
 
 def plot_bitrate(csv_file):
     # Read CSV file
-    df = pd.read_csv(csv_file, parse_dates=['Timestamp'])
-    df['Timestamp'] = (df['Timestamp'] - df['Timestamp'].min()).dt.total_seconds()
+    df = pd.read_csv(csv_file, parse_dates=['timestamp'])
+    df['timestamp'] = (df['timestamp'] - df['timestamp'].min()).dt.total_seconds()
 
     # Filter only video data
-    video_df = df[df['Kind'] == 'video']
+    video_df = df[df['kind'] == 'video']
     fig, ax1 = plt.subplots(figsize=(12,6))
 
 
 #     # Plot CurrentBitrate and TargetBitrate for Video on primary y-axis
-    ax1.plot(video_df['Timestamp'], video_df['CurrentBitrate'], label='CurrentBitrate (Video)', color='green')
-    ax1.plot(video_df['Timestamp'], video_df['TargetBitrate'], label='TargetBitrate (Video)', linestyle='--', color='red')
+    ax1.plot(video_df['timestamp'], video_df['received_kbps'], label='CurrentBitrate (Video)', color='green')
+    ax1.plot(video_df['timestamp'], video_df['target_kbps'], label='TargetBitrate (Video)', linestyle='--', color='red')
 
 #     ax1.hlines(y=50_000, xmin=0, xmax=120, colors='grey', linestyles='solid', label="bandwidth cap", alpha=0.8)
 #     ax1.vlines(x=120, ymin=10_000, ymax=50_000, colors='grey', linestyles='solid', alpha=0.8)
@@ -35,10 +37,10 @@ def plot_bitrate(csv_file):
 
 
     ax2 = ax1.twinx()
-    ax2.plot(video_df['Timestamp'], video_df['PacketsReceived'], label='PacketsReceived', color='blue', linestyle='solid', alpha=0.2)
+    ax2.plot(video_df['timestamp'], video_df['packets_received'], label='PacketsReceived', color='blue', linestyle='solid', alpha=0.2)
     ax2.set_ylabel('PacketsReceived')
     ax2.tick_params(axis='y')
-    ax2.set_ylim(0, 15000)
+    ax2.set_ylim(0, 500)
 
 
 
@@ -67,4 +69,5 @@ def plot_bitrate(csv_file):
     plt.show()
 
 # Example usage
-plot_bitrate('app.csv')
\ No newline at end of file
+# The per session stats of a peer, data/<date>/<experiment>/<room>-<peer id>.csv
+plot_bitrate(sys.argv[1])
\ No newline at end of file
@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const formatTMMBR uint8 = 3
+
+var errTMMBRTooShort = errors.New("tmmbr: packet too short")
+
+// tmmbr is a Temporary Maximum Media Stream Bit Rate Request (RFC 5104 4.2.1), pion/rtcp doesn't implement it
+type tmmbr struct {
+	SenderSSRC uint32
+	Entries    []tmmbrEntry
+}
+
+type tmmbrEntry struct {
+	SSRC     uint32
+	Bitrate  uint64
+	Overhead uint16
+}
+
+// DestinationSSRC returns the SSRCs the request applies to
+func (t *tmmbr) DestinationSSRC() []uint32 {
+	ssrcs := make([]uint32, 0, len(t.Entries))
+	for _, e := range t.Entries {
+		ssrcs = append(ssrcs, e.SSRC)
+	}
+	return ssrcs
+}
+
+// MarshalSize returns the size of the packet once marshaled
+func (t *tmmbr) MarshalSize() int {
+	return 12 + 8*len(t.Entries)
+}
+
+// Marshal encodes the packet in binary
+func (t *tmmbr) Marshal() ([]byte, error) {
+	header, err := (&rtcp.Header{
+		Count:  formatTMMBR,
+		Type:   rtcp.TypeTransportSpecificFeedback,
+		Length: uint16(t.MarshalSize()/4 - 1),
+	}).Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, t.MarshalSize())
+	copy(raw, header)
+	binary.BigEndian.PutUint32(raw[4:], t.SenderSSRC)
+	// SSRC of media source is unused and set to 0
+
+	for i, e := range t.Entries {
+		// Bitrate is sent as a 17 bit mantissa with a 6 bit exponent
+		mantissa, exp := e.Bitrate, uint32(0)
+		for mantissa >= 1<<17 {
+			mantissa >>= 1
+			exp++
+		}
+
+		offset := 12 + 8*i
+		binary.BigEndian.PutUint32(raw[offset:], e.SSRC)
+		binary.BigEndian.PutUint32(raw[offset+4:], exp<<26|uint32(mantissa)<<9|uint32(e.Overhead&0x1ff))
+	}
+	return raw, nil
+}
+
+// Unmarshal decodes the packet from binary
+func (t *tmmbr) Unmarshal(raw []byte) error {
+	if len(raw) < 12 {
+		return errTMMBRTooShort
+	}
+
+	t.SenderSSRC = binary.BigEndian.Uint32(raw[4:])
+	t.Entries = nil
+	for offset := 12; offset+8 <= len(raw); offset += 8 {
+		fci := binary.BigEndian.Uint32(raw[offset+4:])
+		t.Entries = append(t.Entries, tmmbrEntry{
+			SSRC:     binary.BigEndian.Uint32(raw[offset:]),
+			Bitrate:  uint64(fci>>9&0x1ffff) << (fci >> 26),
+			Overhead: uint16(fci & 0x1ff),
+		})
+	}
+	return nil
+}
+
+// capPublishers tells every publisher how much its subscribers can take. Without simulcast
+// a source is only as useful as its worst subscriber can receive, so the minimum is used.
+// Browsers take a REMB as the budget of the whole connection, so every publisher gets one
+// with the sum over its sources. An admin set cap on the publisher wins. The sum is the
+// subscriberCap of a publisher, even when the feedback is off. Must hold listLock.
+func capPublishers(available map[*videoSource]int) {
+	type publisherBudget struct {
+		total   int
+		entries []tmmbrEntry
+	}
+	capped := map[*webrtc.PeerConnection]bool{}
+	for _, p := range peerConnections {
+		capped[p.peerConnection] = p.publisherCap > 0
+	}
+
+	budgets := map[*webrtc.PeerConnection]*publisherBudget{}
+	for _, s := range videoSources {
+		// Sources nobody receives yet only take a share of an admin cap
+		bitrate, ok := available[s]
+		if !ok && !capped[s.publisher] {
+			continue
+		}
+		b, ok := budgets[s.publisher]
+		if !ok {
+			b = &publisherBudget{}
+			budgets[s.publisher] = b
+		}
+		bitrate = max(bitrate, minVideoBitrate)
+		b.total += bitrate
+		b.entries = append(b.entries, tmmbrEntry{SSRC: s.ssrc, Bitrate: uint64(bitrate)})
+	}
+
+	for _, p := range peerConnections {
+		b, ok := budgets[p.peerConnection]
+		if !ok {
+			p.subscriberCap = 0
+			continue
+		}
+
+		// Split the admin cap over the sources the way the subscribers would
+		if p.publisherCap > 0 {
+			for i := range b.entries {
+				b.entries[i].Bitrate = b.entries[i].Bitrate * uint64(p.publisherCap) / uint64(b.total)
+			}
+			b.total = p.publisherCap
+		}
+		p.subscriberCap = b.total
+		if *publisherFeedback == "off" {
+			continue
+		}
+
+		var pkt rtcp.Packet = &tmmbr{Entries: b.entries}
+		if *publisherFeedback == "remb" {
+			remb := &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: float32(b.total)}
+			for _, e := range b.entries {
+				remb.SSRCs = append(remb.SSRCs, e.SSRC)
+			}
+			pkt = remb
+		}
+		if err := p.peerConnection.WriteRTCP([]rtcp.Packet{pkt}); err != nil {
+			mainLogger.Debugf("Failed to send bitrate cap to peer %s: %v", p.id, err)
+		}
+	}
+}
+
+// adminAuthorized checks the -admin-token, without one only requests from this host are let in
+func adminAuthorized(r *http.Request) bool {
+	if *adminToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// publisherCapHandler lets an admin pin the bitrate of a publisher, bitrate=0 goes back to the estimate
+func publisherCapHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bitrate, err := strconv.Atoi(r.FormValue("bitrate"))
+	if err != nil || bitrate < 0 {
+		http.Error(w, "bitrate must be a positive number of bits per second", http.StatusBadRequest)
+		return
+	}
+
+	listLock.Lock()
+	defer listLock.Unlock()
+
+	for _, p := range peerConnections {
+		if p.id == r.FormValue("peer") {
+			p.publisherCap = bitrate
+			mainLogger.Infof("Publisher cap for peer %s set to %d", p.id, bitrate)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "unknown peer", http.StatusNotFound)
+}
@@ -0,0 +1,332 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	relayModeBroadcast = "broadcast"
+	relayModeDirect    = "direct"
+	relayModeBoth      = "both"
+)
+
+var (
+	errRelayTooLarge    = errors.New("message is too large")
+	errRelayRateLimited = errors.New("rate limited")
+	errRelayNoBroadcast = errors.New("broadcast is not allowed on this label")
+	errRelayNoDirect    = errors.New("direct messages are not allowed on this label")
+	errRelayNoRecipient = errors.New("recipient is not in the room")
+	errRelayQueueFull   = errors.New("too many messages while the channel opens")
+	errRelayDropped     = errors.New("message was not delivered to")
+)
+
+// relayConfig relays data channel messages between the participants of a room
+type relayConfig struct {
+	// Labels maps a data channel label to its rule, channels with other labels are not relayed
+	Labels map[string]relayRule `json:"labels"`
+}
+
+// relayRule is how the messages of one label are relayed
+type relayRule struct {
+	// Mode is broadcast, direct or both
+	Mode string `json:"mode"`
+	// MaxMessageSize in bytes, larger messages are rejected
+	MaxMessageSize int `json:"maxMessageSize"`
+	// Rate is the messages per second a participant may send on the label, Burst how many at once
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (c *relayConfig) setDefaults() {
+	for label, rule := range c.Labels {
+		if rule.Mode == "" {
+			rule.Mode = relayModeBoth
+		}
+		if rule.MaxMessageSize == 0 {
+			rule.MaxMessageSize = 16 << 10
+		}
+		if rule.Rate == 0 {
+			rule.Rate = 10
+		}
+		if rule.Burst == 0 {
+			rule.Burst = max(1, int(2*rule.Rate))
+		}
+		c.Labels[label] = rule
+	}
+}
+
+func (c *relayConfig) validate(reserved ...string) error {
+	for label, rule := range c.Labels {
+		if slices.Contains(reserved, label) {
+			return fmt.Errorf("relay: label %q is used by the server", label)
+		}
+		if rule.Mode != relayModeBroadcast && rule.Mode != relayModeDirect && rule.Mode != relayModeBoth {
+			return fmt.Errorf("relay: label %q: mode %q must be %s, %s or %s", label, rule.Mode, relayModeBroadcast, relayModeDirect, relayModeBoth)
+		}
+		if rule.MaxMessageSize < 0 || rule.Rate < 0 || rule.Burst < 0 {
+			return fmt.Errorf("relay: label %q: limits must be positive", label)
+		}
+	}
+	return nil
+}
+
+func (r relayRule) allowsBroadcast() bool {
+	return r.Mode == relayModeBroadcast || r.Mode == relayModeBoth
+}
+
+func (r relayRule) allowsDirect() bool {
+	return r.Mode == relayModeDirect || r.Mode == relayModeBoth
+}
+
+// relayEnvelope wraps text messages. Senders set To for a direct message and leave it out to
+// broadcast, the relay fills in From.
+type relayEnvelope struct {
+	From string          `json:"from,omitempty"`
+	To   string          `json:"to,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
+// stampEnvelope sets From of a text message to the sender and returns it with its recipient,
+// empty for everyone
+func stampEnvelope(from string, data []byte) (payload []byte, to string, err error) {
+	envelope := relayEnvelope{}
+	if err = json.Unmarshal(data, &envelope); err != nil {
+		return nil, "", fmt.Errorf("text messages must be a relay envelope: %w", err)
+	}
+	envelope.From = from
+	if payload, err = json.Marshal(envelope); err != nil {
+		return nil, "", err
+	}
+	return payload, envelope.To, nil
+}
+
+// tokenBucket limits the messages of a participant on one label
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// relayChannelKey identifies a channel the server opened to a participant, one per label
+// and reliability so the settings of the sender are kept
+type relayChannelKey struct {
+	label             string
+	protocol          string
+	ordered           bool
+	maxRetransmits    int
+	maxPacketLifeTime int
+}
+
+func newRelayChannelKey(d *webrtc.DataChannel) relayChannelKey {
+	key := relayChannelKey{label: d.Label(), protocol: d.Protocol(), ordered: d.Ordered(), maxRetransmits: -1, maxPacketLifeTime: -1}
+	if v := d.MaxRetransmits(); v != nil {
+		key.maxRetransmits = int(*v)
+	}
+	if v := d.MaxPacketLifeTime(); v != nil {
+		key.maxPacketLifeTime = int(*v)
+	}
+	return key
+}
+
+func (k relayChannelKey) init() *webrtc.DataChannelInit {
+	init := &webrtc.DataChannelInit{Ordered: &k.ordered, Protocol: &k.protocol}
+	if k.maxRetransmits >= 0 {
+		v := uint16(k.maxRetransmits)
+		init.MaxRetransmits = &v
+	}
+	if k.maxPacketLifeTime >= 0 {
+		v := uint16(k.maxPacketLifeTime)
+		init.MaxPacketLifeTime = &v
+	}
+	return init
+}
+
+// relayChannel is a channel the server opened to a participant. Messages wait in pending
+// until it is open.
+type relayChannel struct {
+	d       *webrtc.DataChannel
+	open    bool
+	pending []webrtc.DataChannelMessage
+}
+
+// peerRelay is the relay state of one participant
+type peerRelay struct {
+	mu       sync.Mutex
+	limits   map[string]*tokenBucket
+	channels map[relayChannelKey]*relayChannel
+}
+
+func newPeerRelay() *peerRelay {
+	return &peerRelay{limits: map[string]*tokenBucket{}, channels: map[relayChannelKey]*relayChannel{}}
+}
+
+func (r *peerRelay) allow(label string, rule relayRule, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bucket, ok := r.limits[label]
+	if !ok {
+		bucket = &tokenBucket{rate: rule.Rate, burst: float64(rule.Burst), tokens: float64(rule.Burst)}
+		r.limits[label] = bucket
+	}
+	return bucket.allow(now)
+}
+
+// send relays msg to participant p on the channel for key, opening it on the first message.
+// Until it is open at most queueLimit messages are held back.
+func (r *peerRelay) send(p *peerConnectionState, key relayChannelKey, msg webrtc.DataChannelMessage, queueLimit int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.channels[key]
+	if !ok {
+		var err error
+		if c, err = r.openChannel(p, key); err != nil {
+			return err
+		}
+	}
+	if !c.open {
+		if len(c.pending) >= queueLimit {
+			return errRelayQueueFull
+		}
+		c.pending = append(c.pending, msg)
+		return nil
+	}
+	return sendRelayed(c.d, msg)
+}
+
+// openChannel creates the channel for key. Must hold r.mu.
+func (r *peerRelay) openChannel(p *peerConnectionState, key relayChannelKey) (*relayChannel, error) {
+	d, err := p.peerConnection.CreateDataChannel(key.label, key.init())
+	if err != nil {
+		return nil, err
+	}
+	c := &relayChannel{d: d}
+
+	// Messages are sent under the lock, so the queued ones go out before any newer one
+	d.OnOpen(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		c.open = true
+		for _, msg := range c.pending {
+			if err := sendRelayed(d, msg); err != nil {
+				mainLogger.Errorf("Failed to relay message to peer %s on '%s': %v", p.id, key.label, err)
+			}
+		}
+		c.pending = nil
+	})
+	// The participant can answer on the channel we opened
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		relayMessage(p, d, msg)
+	})
+	d.OnClose(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if len(c.pending) != 0 {
+			mainLogger.Warnf("Dropped %d relayed messages to peer %s, '%s' closed before it opened", len(c.pending), p.id, key.label)
+		}
+		if r.channels[key] == c {
+			delete(r.channels, key)
+		}
+	})
+	r.channels[key] = c
+	return c, nil
+}
+
+func sendRelayed(d *webrtc.DataChannel, msg webrtc.DataChannelMessage) error {
+	if msg.IsString {
+		return d.SendText(string(msg.Data))
+	}
+	return d.Send(msg.Data)
+}
+
+// relayMessage forwards a message from p to the other participants of its room
+func relayMessage(p *peerConnectionState, source *webrtc.DataChannel, msg webrtc.DataChannelMessage) {
+	rule := config.Relay.Labels[source.Label()]
+	if err := routeMessage(p, source, rule, msg); err != nil {
+		mainLogger.Warnf("Not relaying message of peer %s on '%s': %v", p.id, source.Label(), err)
+		reply, _ := json.Marshal(map[string]string{"type": "error", "error": err.Error()})
+		if err = source.SendText(string(reply)); err != nil {
+			mainLogger.Errorf("❌ SERVER: Failed to send message on DataChannel '%s': %v", source.Label(), err)
+		}
+	}
+}
+
+func routeMessage(p *peerConnectionState, source *webrtc.DataChannel, rule relayRule, msg webrtc.DataChannelMessage) error {
+	if len(msg.Data) > rule.MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes, at most %d", errRelayTooLarge, len(msg.Data), rule.MaxMessageSize)
+	}
+	if !p.relay.allow(source.Label(), rule, time.Now()) {
+		return errRelayRateLimited
+	}
+
+	// Binary messages have no room for an address, they always go to everyone
+	payload, to := msg.Data, ""
+	if msg.IsString {
+		var err error
+		if payload, to, err = stampEnvelope(p.id, msg.Data); err != nil {
+			return err
+		}
+	}
+	if to == "" && !rule.allowsBroadcast() {
+		return errRelayNoBroadcast
+	}
+	if to != "" && !rule.allowsDirect() {
+		return errRelayNoDirect
+	}
+
+	listLock.RLock()
+	recipients := []*peerConnectionState{}
+	for _, other := range peerConnections {
+		if other == p || other.room != p.room || other.peerConnection.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+		if to == "" || other.id == to {
+			recipients = append(recipients, other)
+		}
+	}
+	listLock.RUnlock()
+	if to != "" && len(recipients) == 0 {
+		return fmt.Errorf("%w: %s", errRelayNoRecipient, to)
+	}
+
+	key := newRelayChannelKey(source)
+	relayed := webrtc.DataChannelMessage{IsString: msg.IsString, Data: payload}
+	dropped := []string{}
+	for _, other := range recipients {
+		if err := other.relay.send(other, key, relayed, rule.Burst); err != nil {
+			mainLogger.Errorf("Failed to relay message to peer %s on '%s': %v", other.id, key.label, err)
+			dropped = append(dropped, other.id)
+		}
+	}
+	if len(dropped) != 0 {
+		return fmt.Errorf("%w: %s", errRelayDropped, strings.Join(dropped, ", "))
+	}
+	return nil
+}
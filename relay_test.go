@@ -0,0 +1,187 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// newTestRelayPeer returns a peer with an unconnected PeerConnection and a channel on label
+func newTestRelayPeer(t *testing.T, id, label string) (*peerConnectionState, *webrtc.DataChannel) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	d, err := pc.CreateDataChannel(label, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &peerConnectionState{id: id, room: "test", peerConnection: pc, relay: newPeerRelay()}, d
+}
+
+func TestStampEnvelope(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		data   string
+		wantTo string
+		want   string
+		fails  bool
+	}{
+		{name: "broadcast", data: `{"data": {"x": 1}}`, want: `{"from":"alice","data":{"x":1}}`},
+		{name: "direct", data: `{"to": "bob", "data": "hi"}`, wantTo: "bob", want: `{"from":"alice","to":"bob","data":"hi"}`},
+		{name: "nested data", data: `{"data": {"a": [1, "two"]}}`, want: `{"from":"alice","data":{"a":[1,"two"]}}`},
+		{name: "forged sender", data: `{"from": "bob", "data": 1}`, want: `{"from":"alice","data":1}`},
+		{name: "not json", data: `hello world`, fails: true},
+		{name: "not an object", data: `[1, 2]`, fails: true},
+	} {
+		payload, to, err := stampEnvelope("alice", []byte(test.data))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, payload)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if to != test.wantTo || string(payload) != test.want {
+			t.Errorf("%s: expected %s to %q, got %s to %q", test.name, test.want, test.wantTo, payload, to)
+		}
+	}
+}
+
+func TestRouteMessageRules(t *testing.T) {
+	text := func(data string) webrtc.DataChannelMessage {
+		return webrtc.DataChannelMessage{IsString: true, Data: []byte(data)}
+	}
+	binary := webrtc.DataChannelMessage{Data: []byte{1, 2, 3}}
+
+	for _, test := range []struct {
+		name string
+		mode string
+		msg  webrtc.DataChannelMessage
+		want error
+	}{
+		{name: "broadcast", mode: relayModeBroadcast, msg: text(`{"data": 1}`)},
+		{name: "binary broadcast", mode: relayModeBoth, msg: binary},
+		{name: "broadcast on direct only label", mode: relayModeDirect, msg: text(`{"data": 1}`), want: errRelayNoBroadcast},
+		{name: "binary on direct only label", mode: relayModeDirect, msg: binary, want: errRelayNoBroadcast},
+		{name: "direct on broadcast only label", mode: relayModeBroadcast, msg: text(`{"to": "bob", "data": 1}`), want: errRelayNoDirect},
+		{name: "direct to a peer not in the room", mode: relayModeDirect, msg: text(`{"to": "bob", "data": 1}`), want: errRelayNoRecipient},
+		{name: "too large", mode: relayModeBoth, msg: text(`{"data": "` + string(make([]byte, 100)) + `"}`), want: errRelayTooLarge},
+	} {
+		p, d := newTestRelayPeer(t, "alice", "chat")
+		rule := relayRule{Mode: test.mode, MaxMessageSize: 64, Rate: 10, Burst: 10}
+
+		err := routeMessage(p, d, rule, test.msg)
+		if !errors.Is(err, test.want) || (test.want == nil && err != nil) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+	}
+}
+
+func TestRouteMessageRateLimit(t *testing.T) {
+	p, d := newTestRelayPeer(t, "alice", "chat")
+	rule := relayRule{Mode: relayModeBoth, MaxMessageSize: 64, Rate: 1, Burst: 2}
+	msg := webrtc.DataChannelMessage{IsString: true, Data: []byte(`{"data": 1}`)}
+
+	for i := 0; i < 2; i++ {
+		if err := routeMessage(p, d, rule, msg); err != nil {
+			t.Fatalf("message %d within the burst: %v", i, err)
+		}
+	}
+	if err := routeMessage(p, d, rule, msg); !errors.Is(err, errRelayRateLimited) {
+		t.Fatalf("expected the message after the burst to be rate limited, got %v", err)
+	}
+
+	// Rejected messages still count against the sender
+	if err := routeMessage(p, d, rule, webrtc.DataChannelMessage{IsString: true, Data: []byte(`nope`)}); !errors.Is(err, errRelayRateLimited) {
+		t.Fatalf("expected invalid messages to be rate limited too, got %v", err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := &tokenBucket{rate: 2, burst: 3, tokens: 3}
+
+	for _, step := range []struct {
+		at   time.Duration
+		want bool
+	}{
+		// The burst goes at once
+		{0, true}, {0, true}, {0, true}, {0, false},
+		// Two tokens a second
+		{250 * time.Millisecond, false},
+		{500 * time.Millisecond, true},
+		{500 * time.Millisecond, false},
+		// Refilling stops at the burst
+		{10 * time.Second, true}, {10 * time.Second, true}, {10 * time.Second, true}, {10 * time.Second, false},
+	} {
+		if got := b.allow(start.Add(step.at)); got != step.want {
+			t.Fatalf("at %s: expected allow %v, got %v with %.2f tokens", step.at, step.want, got, b.tokens)
+		}
+	}
+}
+
+func TestRelayQueuesUntilOpen(t *testing.T) {
+	p, d := newTestRelayPeer(t, "bob", "chat")
+	key := newRelayChannelKey(d)
+	msg := webrtc.DataChannelMessage{IsString: true, Data: []byte(`{"from":"alice","data":1}`)}
+
+	// The channel can't open without a connection, so everything waits
+	for i := 0; i < 3; i++ {
+		if err := p.relay.send(p, key, msg, 3); err != nil {
+			t.Fatalf("message %d within the queue limit: %v", i, err)
+		}
+	}
+	if err := p.relay.send(p, key, msg, 3); !errors.Is(err, errRelayQueueFull) {
+		t.Fatalf("expected the queue to be full, got %v", err)
+	}
+
+	p.relay.mu.Lock()
+	defer p.relay.mu.Unlock()
+	if len(p.relay.channels) != 1 {
+		t.Fatalf("expected one channel for the label, got %d", len(p.relay.channels))
+	}
+	if c := p.relay.channels[key]; c.open || len(c.pending) != 3 {
+		t.Fatalf("expected 3 pending messages on a closed channel, got %d, open %v", len(c.pending), c.open)
+	}
+}
+
+func TestRelayConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		rules map[string]relayRule
+		fails bool
+	}{
+		{name: "defaults", rules: map[string]relayRule{"chat": {}}},
+		{name: "all modes", rules: map[string]relayRule{"a": {Mode: relayModeBroadcast}, "b": {Mode: relayModeDirect}, "c": {Mode: relayModeBoth}}},
+		{name: "unknown mode", rules: map[string]relayRule{"chat": {Mode: "multicast"}}, fails: true},
+		{name: "negative size", rules: map[string]relayRule{"chat": {MaxMessageSize: -1}}, fails: true},
+		{name: "negative rate", rules: map[string]relayRule{"chat": {Rate: -1}}, fails: true},
+		{name: "server label", rules: map[string]relayRule{controlLabel: {}}, fails: true},
+	} {
+		c := &relayConfig{Labels: test.rules}
+		c.setDefaults()
+		if err := c.validate(controlLabel); (err != nil) != test.fails {
+			t.Errorf("%s: expected failure %v, got %v", test.name, test.fails, err)
+		}
+	}
+
+	c := &relayConfig{Labels: map[string]relayRule{"chat": {Rate: 4}}}
+	c.setDefaults()
+	if rule := c.Labels["chat"]; rule.Mode != relayModeBoth || rule.MaxMessageSize != 16<<10 || rule.Burst != 8 {
+		t.Errorf("unexpected defaults %+v", rule)
+	}
+}
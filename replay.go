@@ -0,0 +1,243 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+// Header extension ID the replayed packets carry their transport-wide sequence number in
+const replayTWCCExtID = 1
+
+// replayConfig is one estimator configuration of a replay
+type replayConfig struct {
+	// Label names the output column, defaults to the estimator
+	Label     string `json:"label"`
+	Estimator string `json:"estimator"`
+	// BWE is merged over the bwe section of the server config
+	BWE json.RawMessage `json:"bwe"`
+}
+
+// replayableEstimator can be replayed in trace time. Estimators that don't implement it
+// follow the wall clock, so the trace is played back in real time for them.
+type replayableEstimator interface {
+	replaySent(at time.Time, seq uint16, ssrc uint32, size int)
+	replayFeedback(at time.Time, fb *rtcp.TransportLayerCC)
+}
+
+// replayer feeds a trace into one estimator
+type replayer struct {
+	label     string
+	estimator cc.BandwidthEstimator
+	writers   map[uint32]interceptor.RTPWriter
+}
+
+func newReplayer(rc replayConfig) (*replayer, error) {
+	cfg := config.BWE
+	if len(rc.BWE) != 0 {
+		if err := json.Unmarshal(rc.BWE, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", rc.Label, err)
+		}
+	}
+
+	factory, ok := bandwidthEstimators[rc.Estimator]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w %q, choose one of %v", rc.Label, errUnknownEstimator, rc.Estimator, bandwidthEstimatorNames())
+	}
+	estimator, err := factory(cfg, newShadowPacer())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rc.Label, err)
+	}
+	return &replayer{label: rc.Label, estimator: estimator, writers: map[uint32]interceptor.RTPWriter{}}, nil
+}
+
+func (r *replayer) sent(at time.Time, packet *twccTraceSentPacket) error {
+	if e, ok := r.estimator.(replayableEstimator); ok {
+		e.replaySent(at, packet.SequenceNumber, packet.SSRC, packet.Size)
+		return nil
+	}
+
+	writer, ok := r.writers[packet.SSRC]
+	if !ok {
+		writer = r.estimator.AddStream(&interceptor.StreamInfo{
+			SSRC:                packet.SSRC,
+			RTPHeaderExtensions: []interceptor.RTPHeaderExtension{{URI: sdp.TransportCCURI, ID: replayTWCCExtID}},
+		}, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+			return header.MarshalSize() + len(payload), nil
+		}))
+		r.writers[packet.SSRC] = writer
+	}
+
+	ext, err := (&rtp.TransportCCExtension{TransportSequence: packet.SequenceNumber}).Marshal()
+	if err != nil {
+		return err
+	}
+	header := &rtp.Header{Version: 2, SSRC: packet.SSRC}
+	if err = header.SetExtension(replayTWCCExtID, ext); err != nil {
+		return err
+	}
+	_, err = writer.Write(header, make([]byte, max(0, packet.Size-header.MarshalSize())), interceptor.Attributes{})
+	return err
+}
+
+func (r *replayer) feedback(at time.Time, fb *rtcp.TransportLayerCC) error {
+	if e, ok := r.estimator.(replayableEstimator); ok {
+		e.replayFeedback(at, fb)
+		return nil
+	}
+	return r.estimator.WriteRTCP([]rtcp.Packet{fb}, interceptor.Attributes{})
+}
+
+// runReplay is the replay subcommand. It plays a TWCC trace through one or more estimator
+// configurations and writes their target bitrates as CSV time series.
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	tracePath := flags.String("trace", "", "TWCC trace to replay, recorded with twcc-trace")
+	estimators := flags.String("estimators", "gcc", "comma separated estimators to replay with the bwe config, unless -sweep is given")
+	sweepPath := flags.String("sweep", "", `JSON list of {"label", "estimator", "bwe"} configurations to replay`)
+	interval := flags.Duration("interval", 100*time.Millisecond, "sampling interval of the target bitrates")
+	speed := flags.Float64("speed", 1, "playback speed for estimators that follow the wall clock, anything but 1 distorts them")
+	outPath := flags.String("out", "", "CSV file to write, stdout when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *tracePath == "" {
+		return errors.New("replay: -trace is required")
+	}
+	if *interval <= 0 || *speed <= 0 {
+		return errors.New("replay: -interval and -speed must be positive")
+	}
+
+	configs := []replayConfig{}
+	if *sweepPath != "" {
+		raw, err := os.ReadFile(*sweepPath)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(raw, &configs); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", *sweepPath, err)
+		}
+	} else {
+		for _, name := range strings.Split(*estimators, ",") {
+			configs = append(configs, replayConfig{Estimator: strings.TrimSpace(name)})
+		}
+	}
+
+	replayers := []*replayer{}
+	defer func() {
+		for _, r := range replayers {
+			_ = r.estimator.Close()
+		}
+	}()
+	labels := map[string]bool{}
+	realtime := false
+	for _, rc := range configs {
+		if rc.Label == "" {
+			rc.Label = rc.Estimator
+		}
+		if labels[rc.Label] {
+			return fmt.Errorf("replay: label %q is used twice", rc.Label)
+		}
+		labels[rc.Label] = true
+
+		r, err := newReplayer(rc)
+		if err != nil {
+			return err
+		}
+		replayers = append(replayers, r)
+		if _, ok := r.estimator.(replayableEstimator); !ok {
+			realtime = true
+		}
+	}
+
+	file, err := os.Open(*tracePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint: errcheck
+	reader, err := newTWCCTraceReader(file)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *outPath != "" {
+		if out, err = os.Create(*outPath); err != nil {
+			return err
+		}
+		defer out.Close() //nolint: errcheck
+	}
+
+	header := "Seconds"
+	for _, r := range replayers {
+		header += "," + r.label
+	}
+	fmt.Fprintln(out, header)
+	sample := func(at time.Duration) {
+		row := fmt.Sprintf("%.3f", at.Seconds())
+		for _, r := range replayers {
+			row += fmt.Sprintf(",%d", r.estimator.GetTargetBitrate())
+		}
+		fmt.Fprintln(out, row)
+	}
+
+	if realtime {
+		mainLogger.Infof("Replaying %s in real time at %.1fx", *tracePath, *speed)
+	}
+
+	var first time.Time
+	var next time.Duration
+	start := time.Now()
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if errors.Is(err, errInvalidTWCCTrace) && !first.IsZero() {
+			mainLogger.Warnf("Stopping replay early: %v", err)
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if first.IsZero() {
+			first = record.Time
+		}
+		at := record.Time.Sub(first)
+		for ; next <= at; next += *interval {
+			sample(next)
+		}
+		if realtime {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(at) / *speed))))
+		}
+
+		for _, r := range replayers {
+			if record.Sent != nil {
+				err = r.sent(record.Time, record.Sent)
+			} else {
+				err = r.feedback(record.Time, record.Feedback)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", r.label, err)
+			}
+		}
+	}
+	sample(next)
+	return nil
+}
@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// shadowPacer stands in for the pacer of a shadow estimator. Packets go straight
+// through to the stream writer and the target bitrate is ignored.
+type shadowPacer struct {
+	mu      sync.RWMutex
+	writers map[uint32]interceptor.RTPWriter
+}
+
+func newShadowPacer() *shadowPacer {
+	return &shadowPacer{writers: map[uint32]interceptor.RTPWriter{}}
+}
+
+// AddStream registers the writer of a stream
+func (p *shadowPacer) AddStream(ssrc uint32, writer interceptor.RTPWriter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writers[ssrc] = writer
+}
+
+// Write passes the packet on without delay
+func (p *shadowPacer) Write(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+	p.mu.RLock()
+	writer, ok := p.writers[header.SSRC]
+	p.mu.RUnlock()
+	if !ok {
+		return header.MarshalSize() + len(payload), nil
+	}
+	return writer.Write(header, payload, attributes)
+}
+
+// SetTargetBitrate is ignored, shadows don't control sending
+func (p *shadowPacer) SetTargetBitrate(int) {}
+
+// Close does nothing
+func (p *shadowPacer) Close() error { return nil }
+
+// shadowEstimator is one estimator that only observes a connection
+type shadowEstimator struct {
+	name      string
+	estimator cc.BandwidthEstimator
+}
+
+// shadowedEstimator runs shadow estimators next to the active one. Every shadow sees the
+// same packets, at the moment the active pacer sends them, and the same feedback, but
+// only the active estimator drives the pacer. Everything else is delegated to the active one.
+type shadowedEstimator struct {
+	cc.BandwidthEstimator
+	shadows []shadowEstimator
+}
+
+// newShadowedEstimator creates the active estimator and its shadows by name. Without
+// shadows the active estimator is returned as is.
+func newShadowedEstimator(active string, shadows []string, sendPacer *pacer) (cc.BandwidthEstimator, error) {
+	estimator, err := newBandwidthEstimator(active, sendPacer)
+	if err != nil || len(shadows) == 0 {
+		return estimator, err
+	}
+
+	e := &shadowedEstimator{BandwidthEstimator: estimator}
+	for _, name := range shadows {
+		shadow, err := newBandwidthEstimator(name, newShadowPacer())
+		if err != nil {
+			return nil, errors.Join(err, e.Close())
+		}
+		e.shadows = append(e.shadows, shadowEstimator{name: name, estimator: shadow})
+	}
+	return e, nil
+}
+
+// AddStream chains the shadows between the active pacer and the stream writer
+func (e *shadowedEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	for _, shadow := range e.shadows {
+		writer = shadow.estimator.AddStream(info, writer)
+	}
+	return e.BandwidthEstimator.AddStream(info, writer)
+}
+
+// WriteRTCP hands the feedback to every estimator
+func (e *shadowedEstimator) WriteRTCP(pkts []rtcp.Packet, attributes interceptor.Attributes) error {
+	errs := []error{e.BandwidthEstimator.WriteRTCP(pkts, attributes)}
+	for _, shadow := range e.shadows {
+		errs = append(errs, shadow.estimator.WriteRTCP(pkts, attributes))
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the active estimator and all shadows
+func (e *shadowedEstimator) Close() error {
+	errs := []error{e.BandwidthEstimator.Close()}
+	for _, shadow := range e.shadows {
+		errs = append(errs, shadow.estimator.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// shadowTargets returns the target bitrate of every shadow of estimator, in configured order
+func shadowTargets(estimator cc.BandwidthEstimator) []int {
+	e, ok := estimator.(*shadowedEstimator)
+	if !ok {
+		return nil
+	}
+
+	targets := make([]int, 0, len(e.shadows))
+	for _, shadow := range e.shadows {
+		targets = append(targets, shadow.estimator.GetTargetBitrate())
+	}
+	return targets
+}
+
+// formatShadowTargets renders the shadow targets in kbps for the log, next to the active target
+func formatShadowTargets(estimator cc.BandwidthEstimator) string {
+	e, ok := estimator.(*shadowedEstimator)
+	if !ok {
+		return ""
+	}
+
+	out := ""
+	for _, shadow := range e.shadows {
+		out += fmt.Sprintf(", Shadow %s: %v", shadow.name, shadow.estimator.GetTargetBitrate()/1000)
+	}
+	return out
+}
+
+// parseShadows splits a comma separated list of estimator names and checks they exist
+func parseShadows(list string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := bandwidthEstimators[name]; !ok {
+			return nil, fmt.Errorf("%w %q, choose one of %v", errUnknownEstimator, name, bandwidthEstimatorNames())
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
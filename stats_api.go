@@ -0,0 +1,269 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// peerStats is the state of one PeerConnection, as served by /api/stats
+type peerStats struct {
+	ID                 string `json:"id"`
+	Room               string `json:"room"`
+	ClientType         string `json:"clientType"`
+	ConnectionState    string `json:"connectionState"`
+	ICEConnectionState string `json:"iceConnectionState"`
+
+	CandidatePair *candidatePairStats `json:"candidatePair,omitempty"`
+	// RTT of the ICE connectivity checks in milliseconds
+	RTT float64 `json:"rtt"`
+
+	TargetBitrate  int                  `json:"targetBitrate"`
+	UplinkEstimate int                  `json:"uplinkEstimate"`
+	Pacer          PacerStats           `json:"pacer"`
+	Inbound        []inboundTrackStats  `json:"inbound"`
+	Outbound       []outboundTrackStats `json:"outbound"`
+
+	// Only in /api/stats/{peer}
+	Uplink     map[string]interface{} `json:"uplink,omitempty"`
+	BWE        *bweSnapshot           `json:"bwe,omitempty"`
+	Allocation *bandwidthAllocation   `json:"allocation,omitempty"`
+}
+
+type candidatePairStats struct {
+	Local         string `json:"local"`
+	LocalType     string `json:"localType"`
+	Remote        string `json:"remote"`
+	RemoteType    string `json:"remoteType"`
+	Protocol      string `json:"protocol"`
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+}
+
+// inboundTrackStats is a stream a publisher sends us
+type inboundTrackStats struct {
+	Track    string `json:"track"`
+	StreamID string `json:"streamId"`
+	RID      string `json:"rid,omitempty"`
+	SSRC     uint32 `json:"ssrc"`
+	Kind     string `json:"kind"`
+	Codec    string `json:"codec"`
+
+	PacketsReceived uint64 `json:"packetsReceived"`
+	PacketsLost     int64  `json:"packetsLost"`
+	BytesReceived   uint64 `json:"bytesReceived"`
+	// Jitter in milliseconds
+	Jitter     float64   `json:"jitter"`
+	NACKsSent  uint32    `json:"nacksSent"`
+	PLIsSent   uint32    `json:"plisSent"`
+	FIRsSent   uint32    `json:"firsSent"`
+	LastPacket time.Time `json:"lastPacket"`
+
+	Bitrate *BitrateStats `json:"bitrate,omitempty"`
+}
+
+// outboundTrackStats is a stream we send a subscriber, Source is the publisher track a
+// video down-track currently forwards
+type outboundTrackStats struct {
+	Track  string `json:"track"`
+	Source string `json:"source,omitempty"`
+	SSRC   uint32 `json:"ssrc"`
+	Kind   string `json:"kind"`
+	Codec  string `json:"codec"`
+	Paused bool   `json:"paused"`
+
+	PacketsSent uint64 `json:"packetsSent"`
+	BytesSent   uint64 `json:"bytesSent"`
+	NACKs       uint32 `json:"nacks"`
+	PLIs        uint32 `json:"plis"`
+	FIRs        uint32 `json:"firs"`
+	// Loss, jitter (milliseconds) and RTT (milliseconds) from the subscriber's receiver reports
+	PacketsLost  int64   `json:"packetsLost"`
+	FractionLost float64 `json:"fractionLost"`
+	Jitter       float64 `json:"jitter"`
+	RTT          float64 `json:"rtt"`
+
+	// Bitrate the allocator gave the down-track out of the target bitrate
+	AllocatedBitrate int `json:"allocatedBitrate"`
+	// Client is the subscriber's latest report about rendering the track, unless it is stale
+	Client *clientMetrics `json:"client,omitempty"`
+}
+
+// stats collects the state of the connection. Must hold listLock.
+func (p *peerConnectionState) stats(detail bool) *peerStats {
+	now := time.Now()
+	s := &peerStats{
+		ID:                 p.id,
+		Room:               p.room,
+		ClientType:         p.clientType,
+		ConnectionState:    p.peerConnection.ConnectionState().String(),
+		ICEConnectionState: p.peerConnection.ICEConnectionState().String(),
+		TargetBitrate:      p.estimator.GetTargetBitrate(),
+		UplinkEstimate:     p.uplink.GetEstimate(),
+		Pacer:              p.pacer.Stats(),
+		Inbound:            []inboundTrackStats{},
+		Outbound:           []outboundTrackStats{},
+	}
+	s.CandidatePair, s.RTT = selectedCandidatePair(p.peerConnection.GetStats())
+
+	for _, receiver := range p.peerConnection.GetReceivers() {
+		t := receiver.Track()
+		if t == nil {
+			continue
+		}
+		in := inboundTrackStats{
+			Track:    t.ID(),
+			StreamID: t.StreamID(),
+			RID:      t.RID(),
+			SSRC:     uint32(t.SSRC()),
+			Kind:     t.Kind().String(),
+			Codec:    t.Codec().MimeType,
+		}
+		if rs := p.statsGetter.Get(in.SSRC); rs != nil {
+			in.PacketsReceived = rs.InboundRTPStreamStats.PacketsReceived
+			in.PacketsLost = rs.InboundRTPStreamStats.PacketsLost
+			in.BytesReceived = rs.InboundRTPStreamStats.BytesReceived
+			if clockRate := t.Codec().ClockRate; clockRate != 0 {
+				// Jitter is in RTP timestamp units
+				in.Jitter = rs.InboundRTPStreamStats.Jitter / float64(clockRate) * 1000
+			}
+			in.NACKsSent = rs.InboundRTPStreamStats.NACKCount
+			in.PLIsSent = rs.InboundRTPStreamStats.PLICount
+			in.FIRsSent = rs.InboundRTPStreamStats.FIRCount
+			in.LastPacket = rs.LastPacketReceivedTimestamp
+		}
+		if tracker := p.trackers.get(in.SSRC); tracker != nil {
+			bitrate := tracker.Stats()
+			in.Bitrate = &bitrate
+		}
+		s.Inbound = append(s.Inbound, in)
+	}
+
+	allocated := map[string]int{}
+	if p.lastAllocation != nil {
+		for _, t := range p.lastAllocation.Tracks {
+			// A paused track gets nothing, whatever its share would be
+			if !t.Paused {
+				allocated[t.TrackID] = t.Bitrate
+			}
+		}
+	}
+	for _, sender := range p.peerConnection.GetSenders() {
+		t := sender.Track()
+		if t == nil {
+			continue
+		}
+		params := sender.GetParameters()
+		out := outboundTrackStats{Track: t.ID(), Kind: t.Kind().String(), AllocatedBitrate: allocated[t.ID()], Client: p.client.latest(t.ID(), now)}
+		if len(params.Codecs) != 0 {
+			out.Codec = params.Codecs[0].MimeType
+		}
+		if len(params.Encodings) != 0 {
+			out.SSRC = uint32(params.Encodings[0].SSRC)
+		}
+		for _, d := range p.downTracks {
+			if d.track.ID() != t.ID() {
+				continue
+			}
+			if source := d.currentSource(); source != nil {
+				out.Source = source.id
+			}
+			out.Paused = d.isPaused()
+		}
+		if rs := p.statsGetter.Get(out.SSRC); rs != nil {
+			out.PacketsSent = rs.OutboundRTPStreamStats.PacketsSent
+			out.BytesSent = rs.OutboundRTPStreamStats.BytesSent
+			out.NACKs = rs.OutboundRTPStreamStats.NACKCount
+			out.PLIs = rs.OutboundRTPStreamStats.PLICount
+			out.FIRs = rs.OutboundRTPStreamStats.FIRCount
+			out.PacketsLost = rs.RemoteInboundRTPStreamStats.PacketsLost
+			out.FractionLost = rs.RemoteInboundRTPStreamStats.FractionLost
+			out.Jitter = rs.RemoteInboundRTPStreamStats.Jitter * 1000
+			out.RTT = float64(rs.RemoteInboundRTPStreamStats.RoundTripTime.Microseconds()) / 1000.0
+		}
+		s.Outbound = append(s.Outbound, out)
+	}
+
+	if detail {
+		s.Uplink = p.uplink.GetStats()
+		s.BWE = p.bwe.snapshot()
+		s.Allocation = p.lastAllocation
+	}
+	return s
+}
+
+// selectedCandidatePair finds the nominated pair that succeeded, and its RTT in milliseconds
+func selectedCandidatePair(report webrtc.StatsReport) (*candidatePairStats, float64) {
+	for _, stat := range report {
+		pair, ok := stat.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+
+		s := &candidatePairStats{BytesSent: pair.BytesSent, BytesReceived: pair.BytesReceived}
+		if local, ok := report[pair.LocalCandidateID].(webrtc.ICECandidateStats); ok {
+			s.Local = formatCandidateAddress(local)
+			s.LocalType = local.CandidateType.String()
+			s.Protocol = local.Protocol
+		}
+		if remote, ok := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats); ok {
+			s.Remote = formatCandidateAddress(remote)
+			s.RemoteType = remote.CandidateType.String()
+		}
+		return s, pair.CurrentRoundTripTime * 1000
+	}
+	return nil, 0
+}
+
+func formatCandidateAddress(c webrtc.ICECandidateStats) string {
+	return net.JoinHostPort(c.IP, strconv.Itoa(int(c.Port)))
+}
+
+// statsHandler serves the stats of every peer on /api/stats
+func statsHandler(w http.ResponseWriter, _ *http.Request) {
+	listLock.RLock()
+	peers := make([]*peerStats, 0, len(peerConnections))
+	for _, p := range peerConnections {
+		peers = append(peers, p.stats(false))
+	}
+	listLock.RUnlock()
+
+	writeStatsJSON(w, peers)
+}
+
+// peerStatsHandler serves the detailed stats of one peer on /api/stats/{peer}
+func peerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	peer := r.PathValue("peer")
+
+	var stats *peerStats
+	listLock.RLock()
+	for _, p := range peerConnections {
+		if p.id == peer {
+			stats = p.stats(true)
+		}
+	}
+	listLock.RUnlock()
+
+	if stats == nil {
+		http.Error(w, "unknown peer", http.StatusNotFound)
+		return
+	}
+	writeStatsJSON(w, stats)
+}
+
+func writeStatsJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		mainLogger.Errorf("Failed to encode stats: %v", err)
+	}
+}
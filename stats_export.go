@@ -0,0 +1,254 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	statsFormatCSV   = "csv"
+	statsFormatJSONL = "jsonl"
+)
+
+// statsColumns are the CSV columns of a statsSample, named like its JSON fields. Units are
+// part of the name, so renaming one is a breaking change for the analysis scripts.
+var statsColumns = []string{
+	"timestamp", "experiment", "room", "peer", "track", "rid", "ssrc", "kind",
+	"packets_received", "packets_lost", "loss_ratio", "jitter_ms",
+	"received_kbps", "target_kbps", "uplink_estimate_kbps",
+	"delay_ms", "send_delay_ms", "capture_delay_ms",
+	"window_kbps", "ewma_kbps", "p50_kbps", "p95_kbps",
+}
+
+// experimentLabel keeps labels safe to use as a directory name
+var experimentLabel = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// statsConfig configures the per session stats files
+type statsConfig struct {
+	// Dir is the root of the stats, every session writes to <dir>/<date>/<experiment>/
+	Dir string `json:"dir"`
+	// Format is csv or jsonl
+	Format string `json:"format"`
+	// Experiment labels the run, a websocket can override it with ?experiment=
+	Experiment string `json:"experiment"`
+}
+
+func (c *statsConfig) setDefaults() {
+	if c.Dir == "" {
+		c.Dir = "data"
+	}
+	if c.Format == "" {
+		c.Format = statsFormatCSV
+	}
+	if c.Experiment == "" {
+		c.Experiment = "default"
+	}
+}
+
+func (c *statsConfig) validate() error {
+	if c.Format != statsFormatCSV && c.Format != statsFormatJSONL {
+		return fmt.Errorf("stats: format %q must be %s or %s", c.Format, statsFormatCSV, statsFormatJSONL)
+	}
+	return validateExperiment(c.Experiment)
+}
+
+func validateExperiment(label string) error {
+	if !experimentLabel.MatchString(label) {
+		return fmt.Errorf("experiment %q may only contain letters, digits, '.', '_' and '-'", label)
+	}
+	return nil
+}
+
+// validateRoom keeps rooms safe to use in file names, with the same rule as experiments. No room is fine.
+func validateRoom(room string) error {
+	if room != "" && !experimentLabel.MatchString(room) {
+		return fmt.Errorf("room %q may only contain letters, digits, '.', '_' and '-'", room)
+	}
+	return nil
+}
+
+// sessionDir creates and returns the directory the files of a session started at now go to
+func (c *statsConfig) sessionDir(experiment string, now time.Time) (string, error) {
+	dir := filepath.Join(c.Dir, now.Format("2006-01-02"), experiment)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// statsRecord is a line of a stats file, in JSON Lines it is marshaled as is
+type statsRecord interface {
+	row() []string
+}
+
+// statsSample is one second of an inbound stream. Counters are deltas over the second.
+type statsSample struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Experiment string    `json:"experiment"`
+	Room       string    `json:"room"`
+	Peer       string    `json:"peer"`
+	Track      string    `json:"track"`
+	RID        string    `json:"rid"`
+	SSRC       uint32    `json:"ssrc"`
+	Kind       string    `json:"kind"`
+
+	PacketsReceived uint64  `json:"packets_received"`
+	PacketsLost     int64   `json:"packets_lost"`
+	LossRatio       float64 `json:"loss_ratio"`
+	JitterMs        float64 `json:"jitter_ms"`
+
+	ReceivedKbps       float64 `json:"received_kbps"`
+	TargetKbps         float64 `json:"target_kbps"`
+	UplinkEstimateKbps float64 `json:"uplink_estimate_kbps"`
+
+	// The absolute delays are null when the publisher doesn't send the header extension
+	DelayMs        float64  `json:"delay_ms"`
+	SendDelayMs    *float64 `json:"send_delay_ms"`
+	CaptureDelayMs *float64 `json:"capture_delay_ms"`
+
+	WindowKbps float64 `json:"window_kbps"`
+	EWMAKbps   float64 `json:"ewma_kbps"`
+	P50Kbps    float64 `json:"p50_kbps"`
+	P95Kbps    float64 `json:"p95_kbps"`
+
+	// ShadowTargetsKbps are written as shadow_target_kbps_<name> columns in CSV
+	ShadowTargetsKbps map[string]float64 `json:"shadow_target_kbps,omitempty"`
+	// shadows orders the shadow columns
+	shadows []string
+}
+
+// statsHeader returns the columns of the samples of a session with these shadows
+func statsHeader(shadows []string) []string {
+	header := append([]string{}, statsColumns...)
+	for _, name := range shadows {
+		header = append(header, "shadow_target_kbps_"+name)
+	}
+	return header
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+func formatOptional(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return formatNumber(*v)
+}
+
+func formatOptionalInt(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(*v)
+}
+
+func (s *statsSample) row() []string {
+	number, optional := formatNumber, formatOptional
+
+	row := []string{
+		s.Timestamp.Format(time.RFC3339Nano), s.Experiment, s.Room, s.Peer, s.Track, s.RID,
+		strconv.FormatUint(uint64(s.SSRC), 10), s.Kind,
+		strconv.FormatUint(s.PacketsReceived, 10), strconv.FormatInt(s.PacketsLost, 10),
+		strconv.FormatFloat(s.LossRatio, 'f', 4, 64), number(s.JitterMs),
+		number(s.ReceivedKbps), number(s.TargetKbps), number(s.UplinkEstimateKbps),
+		number(s.DelayMs), optional(s.SendDelayMs), optional(s.CaptureDelayMs),
+		number(s.WindowKbps), number(s.EWMAKbps), number(s.P50Kbps), number(s.P95Kbps),
+	}
+	for _, name := range s.shadows {
+		row = append(row, number(s.ShadowTargetsKbps[name]))
+	}
+	return row
+}
+
+// millis converts a delay for a statsSample, nil when it is not known
+func millis(d time.Duration, ok bool) *float64 {
+	if !ok {
+		return nil
+	}
+	ms := float64(d.Microseconds()) / 1000.0
+	return &ms
+}
+
+// statsExporter writes the records of one session to <room>-<peer><suffix>.csv or .jsonl
+type statsExporter struct {
+	mu   sync.Mutex
+	file *os.File
+	csv  *csv.Writer
+}
+
+func newStatsExporter(dir, room, peer, suffix string, header []string) (*statsExporter, error) {
+	name := peer + suffix
+	if room != "" {
+		name = room + "-" + name
+	}
+	file, err := os.Create(filepath.Join(dir, name+"."+config.Stats.Format)) //nolint: gosec
+	if err != nil {
+		return nil, err
+	}
+
+	e := &statsExporter{file: file}
+	if config.Stats.Format == statsFormatCSV {
+		e.csv = csv.NewWriter(file)
+		if err = e.csv.Write(header); err == nil {
+			e.csv.Flush()
+			err = e.csv.Error()
+		}
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// write appends a record, every line goes to disk right away so a crash loses nothing
+func (e *statsExporter) write(s statsRecord) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file == nil {
+		return
+	}
+
+	var err error
+	if e.csv != nil {
+		if err = e.csv.Write(s.row()); err == nil {
+			e.csv.Flush()
+			err = e.csv.Error()
+		}
+	} else {
+		var line []byte
+		if line, err = json.Marshal(s); err == nil {
+			_, err = e.file.Write(append(line, '\n'))
+		}
+	}
+	if err != nil {
+		mainLogger.Errorf("Failed to write stats to %s: %v", e.file.Name(), err)
+	}
+}
+
+// Close closes the file, later samples are dropped
+func (e *statsExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Samples a slow dashboard can fall behind by before they are dropped
+	statsStreamBuffer = 256
+	// SSE comment sent while there are no samples, so proxies keep the stream open
+	statsStreamKeepAlive = 15 * time.Second
+)
+
+// liveStats fans the per second samples out to the dashboards streaming them
+var liveStats = &statsHub{subscribers: map[*statsSubscriber]struct{}{}}
+
+// statsSubscriber receives the samples matching its filters, an empty filter matches all
+type statsSubscriber struct {
+	room, peer, track string
+
+	samples chan *statsSample
+}
+
+func (s *statsSubscriber) matches(sample *statsSample) bool {
+	return (s.room == "" || s.room == sample.Room) &&
+		(s.peer == "" || s.peer == sample.Peer) &&
+		(s.track == "" || s.track == sample.Track)
+}
+
+type statsHub struct {
+	mu          sync.Mutex
+	subscribers map[*statsSubscriber]struct{}
+}
+
+func (h *statsHub) subscribe(room, peer, track string) *statsSubscriber {
+	s := &statsSubscriber{room: room, peer: peer, track: track, samples: make(chan *statsSample, statsStreamBuffer)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[s] = struct{}{}
+	return s
+}
+
+func (h *statsHub) unsubscribe(s *statsSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, s)
+}
+
+// publish hands a sample to every matching subscriber without waiting for slow ones
+func (h *statsHub) publish(sample *statsSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		if !s.matches(sample) {
+			continue
+		}
+		select {
+		case s.samples <- sample:
+		default:
+		}
+	}
+}
+
+// statsStreamHandler streams the samples as Server-Sent Events, filtered by ?room=, ?peer= and ?track=
+func statsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	sub := liveStats.subscribe(query.Get("room"), query.Get("peer"), query.Get("track"))
+	defer liveStats.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(statsStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case sample := <-sub.samples:
+			var data []byte
+			if data, err = json.Marshal(sample); err == nil {
+				_, err = fmt.Fprintf(w, "event: stats\ndata: %s\n\n", data)
+			}
+		}
+		if err != nil {
+			mainLogger.Infof("Stopped streaming stats to %s: %v", r.RemoteAddr, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// packetResult is what TWCC feedback told us about one sent packet
+type packetResult struct {
+	SequenceNumber uint16
+	SSRC           uint32
+	Size           int
+	Departure      time.Time
+	// Arrival is in the receiver's clock, only differences between arrivals are meaningful
+	Arrival  time.Time
+	Received bool
+}
+
+// Sent packets remembered for feedback, about a second of 1200 byte packets at 40 Mbit/s
+const twccFeedbackHistory = 1 << 12
+
+type sentPacket struct {
+	seq       uint16
+	ssrc      uint32
+	size      int
+	departure time.Time
+	valid     bool
+}
+
+// twccFeedback remembers sent packets by transport-wide sequence number and matches
+// them with TWCC feedback. pion keeps its own adapter internal to gcc, so estimators
+// in this package share this one. Only the last twccFeedbackHistory packets are kept,
+// feedback on older ones is ignored.
+type twccFeedback struct {
+	mu   sync.Mutex
+	sent [twccFeedbackHistory]sentPacket
+}
+
+func newTWCCFeedback() *twccFeedback {
+	return &twccFeedback{}
+}
+
+// onSent records a packet carrying the transport-wide sequence number extension
+func (f *twccFeedback) onSent(now time.Time, header *rtp.Header, size int, twccExtID uint8) {
+	if twccExtID == 0 {
+		return
+	}
+
+	payload := header.GetExtension(twccExtID)
+	if payload == nil {
+		return
+	}
+
+	ext := rtp.TransportCCExtension{}
+	if err := ext.Unmarshal(payload); err != nil {
+		return
+	}
+
+	f.onSentSequence(now, ext.TransportSequence, header.SSRC, header.MarshalSize()+size)
+}
+
+// onSentSequence records a packet by its transport-wide sequence number, size includes the header
+func (f *twccFeedback) onSentSequence(now time.Time, seq uint16, ssrc uint32, size int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sent[seq%twccFeedbackHistory] = sentPacket{
+		seq:       seq,
+		ssrc:      ssrc,
+		size:      size,
+		departure: now,
+		valid:     true,
+	}
+}
+
+// onTransportCCFeedback returns the result of every packet the feedback reports on, in sequence order
+func (f *twccFeedback) onTransportCCFeedback(fb *rtcp.TransportLayerCC) []packetResult {
+	statuses := make([]uint16, 0, fb.PacketStatusCount)
+	for _, chunk := range fb.PacketChunks {
+		switch c := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			for i := uint16(0); i < c.RunLength; i++ {
+				statuses = append(statuses, c.PacketStatusSymbol)
+			}
+		case *rtcp.StatusVectorChunk:
+			for _, symbol := range c.SymbolList {
+				statuses = append(statuses, symbol)
+			}
+		}
+	}
+	if len(statuses) > int(fb.PacketStatusCount) {
+		statuses = statuses[:fb.PacketStatusCount]
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Reference time is in multiples of 64ms, deltas in microseconds
+	arrival := time.Unix(0, 0).Add(time.Duration(fb.ReferenceTime) * 64 * time.Millisecond)
+	results := make([]packetResult, 0, len(statuses))
+	deltas := fb.RecvDeltas
+	for i, status := range statuses {
+		seq := fb.BaseSequenceNumber + uint16(i)
+		result := packetResult{SequenceNumber: seq}
+
+		if status == rtcp.TypeTCCPacketReceivedSmallDelta || status == rtcp.TypeTCCPacketReceivedLargeDelta {
+			if len(deltas) == 0 {
+				break
+			}
+			arrival = arrival.Add(time.Duration(deltas[0].Delta) * time.Microsecond)
+			deltas = deltas[1:]
+			result.Arrival = arrival
+			result.Received = true
+		}
+
+		if sent := f.sent[seq%twccFeedbackHistory]; sent.valid && sent.seq == seq {
+			result.SSRC = sent.ssrc
+			result.Size = sent.size
+			result.Departure = sent.departure
+			results = append(results, result)
+		}
+	}
+	return results
+}
@@ -0,0 +1,259 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+// A TWCC trace starts with twccTraceMagic followed by records, all integers big endian:
+//
+//	'S' time int64 (unix ns), transport-wide seq uint16, SSRC uint32, size uint16 (header and payload)
+//	'F' time int64 (unix ns), length uint16, the TWCC feedback as it was received
+//
+// Arrival times are left inside the feedback, twccTraceReader matches them with the sent packets.
+const twccTraceMagic = "TWCCTRC1"
+
+const (
+	twccTraceSent     = 'S'
+	twccTraceFeedback = 'F'
+)
+
+var errInvalidTWCCTrace = errors.New("invalid twcc trace")
+
+// twccTraceFactory creates a twccTracer per PeerConnection when enabled
+type twccTraceFactory struct {
+	path string
+}
+
+// NewInterceptor opens the trace file, an empty path disables tracing
+func (f *twccTraceFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	if f.path == "" {
+		return &interceptor.NoOp{}, nil
+	}
+
+	file, err := os.Create(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &twccTracer{file: file, w: bufio.NewWriter(file)}
+	if _, err = t.w.WriteString(twccTraceMagic); err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	return t, nil
+}
+
+// twccTracer records every packet sent with a transport-wide sequence number and every
+// TWCC feedback received, for offline analysis of the congestion signal. It has to sit
+// after the pacer so the send times are the real ones.
+type twccTracer struct {
+	interceptor.NoOp
+
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	buf    [17]byte
+	closed bool
+}
+
+// BindLocalStream records the packets of streams that carry the transport-wide sequence number
+func (t *twccTracer) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	var twccExtID uint8
+	for _, ext := range info.RTPHeaderExtensions {
+		if ext.URI == sdp.TransportCCURI {
+			twccExtID = uint8(ext.ID)
+		}
+	}
+	if twccExtID == 0 {
+		return writer
+	}
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if raw := header.GetExtension(twccExtID); raw != nil {
+			ext := rtp.TransportCCExtension{}
+			if err := ext.Unmarshal(raw); err == nil {
+				t.writeSent(time.Now(), ext.TransportSequence, header.SSRC, header.MarshalSize()+len(payload))
+			}
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+// BindRTCPReader records the TWCC feedback
+func (t *twccTracer) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		i, attr, err := reader.Read(b, a)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if attr == nil {
+			attr = make(interceptor.Attributes)
+		}
+		pkts, err := attr.GetRTCPPackets(b[:i])
+		if err != nil {
+			return i, attr, nil //nolint: nilerr
+		}
+
+		now := time.Now()
+		for _, pkt := range pkts {
+			if fb, ok := pkt.(*rtcp.TransportLayerCC); ok {
+				t.writeFeedback(now, fb)
+			}
+		}
+		return i, attr, nil
+	})
+}
+
+func (t *twccTracer) writeSent(now time.Time, seq uint16, ssrc uint32, size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	t.buf[0] = twccTraceSent
+	binary.BigEndian.PutUint64(t.buf[1:], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint16(t.buf[9:], seq)
+	binary.BigEndian.PutUint32(t.buf[11:], ssrc)
+	binary.BigEndian.PutUint16(t.buf[15:], uint16(min(size, 0xffff)))
+	if _, err := t.w.Write(t.buf[:]); err != nil {
+		mainLogger.Errorf("Failed to write twcc trace: %v", err)
+	}
+}
+
+func (t *twccTracer) writeFeedback(now time.Time, fb *rtcp.TransportLayerCC) {
+	raw, err := fb.Marshal()
+	if err != nil {
+		mainLogger.Errorf("Failed to marshal twcc feedback: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	t.buf[0] = twccTraceFeedback
+	binary.BigEndian.PutUint64(t.buf[1:], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint16(t.buf[9:], uint16(len(raw)))
+	if _, err = t.w.Write(t.buf[:11]); err == nil {
+		_, err = t.w.Write(raw)
+	}
+	if err != nil {
+		mainLogger.Errorf("Failed to write twcc trace: %v", err)
+	}
+}
+
+// Close flushes and closes the trace file
+func (t *twccTracer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	return errors.Join(t.w.Flush(), t.file.Close())
+}
+
+// twccTraceSentPacket is a packet we sent
+type twccTraceSentPacket struct {
+	SequenceNumber uint16
+	SSRC           uint32
+	Size           int
+}
+
+// twccTraceRecord is either a sent packet or a feedback, Time is when it happened on our side
+type twccTraceRecord struct {
+	Time     time.Time
+	Sent     *twccTraceSentPacket
+	Feedback *rtcp.TransportLayerCC
+	// Results matches a feedback with the packets sent before it
+	Results []packetResult
+}
+
+// twccTraceReader reads a trace written by twccTracer
+type twccTraceReader struct {
+	r        *bufio.Reader
+	feedback *twccFeedback
+}
+
+func newTWCCTraceReader(r io.Reader) (*twccTraceReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(twccTraceMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != twccTraceMagic {
+		return nil, fmt.Errorf("%w: bad magic", errInvalidTWCCTrace)
+	}
+	return &twccTraceReader{r: br, feedback: newTWCCFeedback()}, nil
+}
+
+// Next returns the next record, io.EOF after the last one
+func (t *twccTraceReader) Next() (*twccTraceRecord, error) {
+	kind, err := t.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	var at int64
+	if err = binary.Read(t.r, binary.BigEndian, &at); err != nil {
+		return nil, t.truncated(err)
+	}
+	record := &twccTraceRecord{Time: time.Unix(0, at)}
+
+	switch kind {
+	case twccTraceSent:
+		var fields struct {
+			Seq  uint16
+			SSRC uint32
+			Size uint16
+		}
+		if err = binary.Read(t.r, binary.BigEndian, &fields); err != nil {
+			return nil, t.truncated(err)
+		}
+		record.Sent = &twccTraceSentPacket{SequenceNumber: fields.Seq, SSRC: fields.SSRC, Size: int(fields.Size)}
+		t.feedback.onSentSequence(record.Time, fields.Seq, fields.SSRC, int(fields.Size))
+	case twccTraceFeedback:
+		var length uint16
+		if err = binary.Read(t.r, binary.BigEndian, &length); err != nil {
+			return nil, t.truncated(err)
+		}
+		raw := make([]byte, length)
+		if _, err = io.ReadFull(t.r, raw); err != nil {
+			return nil, t.truncated(err)
+		}
+		record.Feedback = &rtcp.TransportLayerCC{}
+		if err = record.Feedback.Unmarshal(raw); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidTWCCTrace, err)
+		}
+		record.Results = t.feedback.onTransportCCFeedback(record.Feedback)
+	default:
+		return nil, fmt.Errorf("%w: unknown record type %q", errInvalidTWCCTrace, kind)
+	}
+	return record, nil
+}
+
+// A trace cut short by a crash ends in a partial record
+func (t *twccTraceReader) truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated record", errInvalidTWCCTrace)
+	}
+	return err
+}
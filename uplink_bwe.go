@@ -0,0 +1,291 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+const (
+	// Packets sent within this window form one arrival group
+	uplinkGroupWindow = 5 * time.Millisecond
+	// Number of arrival groups the delay trend is fitted over
+	uplinkTrendWindow = 20
+	uplinkRateWindow  = time.Second
+
+	uplinkMinBitrate = 30_000
+	uplinkMaxBitrate = 50_000_000
+)
+
+// Usage states of the overuse detector
+const (
+	uplinkNormal   = "normal"
+	uplinkOveruse  = "overuse"
+	uplinkUnderuse = "underuse"
+)
+
+// uplinkEstimatorFactory creates an uplinkEstimator per PeerConnection, like the cc interceptor does
+type uplinkEstimatorFactory struct {
+	onNewPeerConnection func(id string, estimator *uplinkEstimator)
+}
+
+// OnNewPeerConnection sets a callback that is called when a new estimator is created
+func (f *uplinkEstimatorFactory) OnNewPeerConnection(cb func(id string, estimator *uplinkEstimator)) {
+	f.onNewPeerConnection = cb
+}
+
+// NewInterceptor returns a new uplinkEstimator
+func (f *uplinkEstimatorFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	e := &uplinkEstimator{
+		threshold: 12.5,
+		state:     uplinkNormal,
+	}
+	if f.onNewPeerConnection != nil {
+		f.onNewPeerConnection(id, e)
+	}
+	return e, nil
+}
+
+type arrivalGroup struct {
+	firstSend   time.Time
+	lastSend    time.Time
+	lastArrival time.Time
+}
+
+type trendSample struct {
+	arrival float64
+	delay   float64
+}
+
+type rateSample struct {
+	at    time.Time
+	bytes int
+}
+
+// uplinkEstimator is a receive-side bandwidth estimator for what a publisher sends us. It
+// follows the delay based part of GCC: packets are grouped by abs-send-time, the growth
+// of the one-way delay is fitted with a trendline and compared against an adaptive threshold,
+// and the estimate is decreased on overuse and slowly increased otherwise.
+type uplinkEstimator struct {
+	interceptor.NoOp
+
+	mu sync.Mutex
+
+	group     *arrivalGroup
+	prevGroup *arrivalGroup
+	first     time.Time
+
+	accumulatedDelay float64
+	smoothedDelay    float64
+	trend            []trendSample
+	numDeltas        int
+	modifiedTrend    float64
+	threshold        float64
+	lastThreshold    time.Time
+	state            string
+
+	rate       []rateSample
+	rateBytes  int
+	estimate   int
+	lastUpdate time.Time
+}
+
+// BindRemoteStream observes every packet of the publisher that carries abs-send-time
+func (e *uplinkEstimator) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	var absSendTimeID uint8
+	for _, ext := range info.RTPHeaderExtensions {
+		if ext.URI == sdp.ABSSendTimeURI {
+			absSendTimeID = uint8(ext.ID)
+		}
+	}
+	if absSendTimeID == 0 {
+		return reader
+	}
+
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		i, attr, err := reader.Read(b, a)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if attr == nil {
+			attr = make(interceptor.Attributes)
+		}
+		header, err := attr.GetRTPHeader(b[:i])
+		if err != nil {
+			return i, attr, nil //nolint: nilerr
+		}
+
+		if payload := header.GetExtension(absSendTimeID); payload != nil {
+			ext := rtp.AbsSendTimeExtension{}
+			if err = ext.Unmarshal(payload); err == nil {
+				now := time.Now()
+				e.onPacket(now, ext.Estimate(now), i)
+			}
+		}
+		return i, attr, nil
+	})
+}
+
+func (e *uplinkEstimator) onPacket(arrival, send time.Time, size int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.first.IsZero() {
+		e.first = arrival
+	}
+	e.addRate(arrival, size)
+
+	switch {
+	case e.group == nil:
+		e.group = &arrivalGroup{firstSend: send, lastSend: send, lastArrival: arrival}
+		return
+	case send.Sub(e.group.firstSend) <= uplinkGroupWindow:
+		if send.After(e.group.lastSend) {
+			e.group.lastSend = send
+		}
+		e.group.lastArrival = arrival
+		return
+	}
+
+	if e.prevGroup != nil {
+		sendDelta := e.group.lastSend.Sub(e.prevGroup.lastSend)
+		arrivalDelta := e.group.lastArrival.Sub(e.prevGroup.lastArrival)
+		e.updateTrend(float64(arrivalDelta-sendDelta)/float64(time.Millisecond), e.group.lastArrival)
+	}
+	e.prevGroup = e.group
+	e.group = &arrivalGroup{firstSend: send, lastSend: send, lastArrival: arrival}
+
+	e.updateEstimate(arrival)
+}
+
+func (e *uplinkEstimator) addRate(now time.Time, size int) {
+	e.rate = append(e.rate, rateSample{at: now, bytes: size})
+	e.rateBytes += size
+	for len(e.rate) != 0 && now.Sub(e.rate[0].at) > uplinkRateWindow {
+		e.rateBytes -= e.rate[0].bytes
+		e.rate = e.rate[1:]
+	}
+}
+
+func (e *uplinkEstimator) incomingBitrate() int {
+	return int(float64(e.rateBytes*8) / uplinkRateWindow.Seconds())
+}
+
+// updateTrend fits the accumulated delay variation of the last groups and runs the overuse detector
+func (e *uplinkEstimator) updateTrend(delayVariation float64, arrival time.Time) {
+	e.numDeltas++
+	e.accumulatedDelay += delayVariation
+	e.smoothedDelay = 0.9*e.smoothedDelay + 0.1*e.accumulatedDelay
+	e.trend = append(e.trend, trendSample{
+		arrival: float64(arrival.Sub(e.first)) / float64(time.Millisecond),
+		delay:   e.smoothedDelay,
+	})
+	if len(e.trend) > uplinkTrendWindow {
+		e.trend = e.trend[1:]
+	}
+	if len(e.trend) < uplinkTrendWindow {
+		return
+	}
+
+	var meanX, meanY float64
+	for _, s := range e.trend {
+		meanX += s.arrival
+		meanY += s.delay
+	}
+	meanX /= float64(len(e.trend))
+	meanY /= float64(len(e.trend))
+
+	var num, den float64
+	for _, s := range e.trend {
+		num += (s.arrival - meanX) * (s.delay - meanY)
+		den += (s.arrival - meanX) * (s.arrival - meanX)
+	}
+	if den == 0 {
+		return
+	}
+
+	e.modifiedTrend = float64(min(e.numDeltas, 60)) * num / den * 4
+
+	switch {
+	case e.modifiedTrend > e.threshold:
+		e.state = uplinkOveruse
+	case e.modifiedTrend < -e.threshold:
+		e.state = uplinkUnderuse
+	default:
+		e.state = uplinkNormal
+	}
+
+	// Adapt the threshold so we neither starve against loss based senders nor react to noise
+	if !e.lastThreshold.IsZero() {
+		abs := math.Abs(e.modifiedTrend)
+		if abs < e.threshold+15 {
+			k := 0.039
+			if abs > e.threshold {
+				k = 0.0087
+			}
+			dt := math.Min(float64(arrival.Sub(e.lastThreshold))/float64(time.Millisecond), 100)
+			e.threshold = math.Max(6, math.Min(600, e.threshold+k*(abs-e.threshold)*dt))
+		}
+	}
+	e.lastThreshold = arrival
+}
+
+// updateEstimate is the AIMD rate controller
+func (e *uplinkEstimator) updateEstimate(now time.Time) {
+	incoming := e.incomingBitrate()
+	if now.Sub(e.first) < uplinkRateWindow {
+		return
+	}
+	if e.estimate == 0 {
+		e.estimate = incoming
+		e.lastUpdate = now
+		return
+	}
+
+	dt := now.Sub(e.lastUpdate).Seconds()
+	switch e.state {
+	case uplinkOveruse:
+		if decreased := int(0.85 * float64(incoming)); decreased < e.estimate {
+			e.estimate = decreased
+		}
+	case uplinkNormal:
+		e.estimate += int(float64(e.estimate) * 0.08 * math.Min(dt, 1))
+		// Don't run away from what is actually being sent
+		e.estimate = min(e.estimate, int(1.5*float64(incoming))+10_000)
+	}
+
+	e.estimate = max(uplinkMinBitrate, min(uplinkMaxBitrate, e.estimate))
+	e.lastUpdate = now
+}
+
+// GetEstimate returns the estimated uplink bitrate of the publisher in bits per second
+func (e *uplinkEstimator) GetEstimate() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.estimate
+}
+
+// GetStats returns the internal state of the estimator
+func (e *uplinkEstimator) GetStats() map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return map[string]interface{}{
+		"estimate":        e.estimate,
+		"incomingBitrate": e.incomingBitrate(),
+		"trend":           e.modifiedTrend,
+		"threshold":       e.threshold,
+		"usage":           e.state,
+	}
+}